@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// addressFilterMaxLine is the maximum line length we scan for
+	// addresses. Longer lines are still printed, but not decoded.
+	addressFilterMaxLine = 4096
+)
+
+// Code addresses in the ESP32 are in the 0x40000000-0x4fffffff range. Like
+// idf_monitor, we look for them anywhere in the output (backtraces, PC and
+// register dumps from the panic handler, etc...).
+var codeAddressRe = regexp.MustCompile(`(?i)0x4[0-9a-f]{7}`)
+
+// addressFilter is an io.Writer which writes its input unmodified to w and,
+// after each complete line, prints the function and source location of any
+// code addresses found in it.
+type addressFilter struct {
+	w       io.Writer
+	resolve func() *Symbolizer
+	line    []byte
+}
+
+func newAddressFilter(w io.Writer, resolve func() *Symbolizer) *addressFilter {
+	return &addressFilter{
+		w:       w,
+		resolve: resolve,
+	}
+}
+
+func (f *addressFilter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	for len(p) > 0 {
+		idx := bytes.IndexByte(p, '\n')
+		if idx < 0 {
+			f.buffer(p)
+			break
+		}
+		f.buffer(p[:idx])
+		f.decodeLine()
+		p = p[idx+1:]
+	}
+	return n, nil
+}
+
+func (f *addressFilter) buffer(p []byte) {
+	if len(f.line)+len(p) <= addressFilterMaxLine {
+		f.line = append(f.line, p...)
+	}
+}
+
+func (f *addressFilter) decodeLine() {
+	line := f.line
+	f.line = f.line[:0]
+	matches := codeAddressRe.FindAll(line, -1)
+	if len(matches) == 0 {
+		return
+	}
+	sym := f.resolve()
+	if sym == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		addr := string(m)
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		// The regexp is case insensitive, so the prefix might be 0X
+		value, err := strconv.ParseUint(addr[2:], 16, 32)
+		if err != nil {
+			continue
+		}
+		if loc := sym.Lookup(value); loc != nil {
+			fmt.Fprintf(f.w, "%s: %s\n", addr, loc)
+		}
+	}
+}
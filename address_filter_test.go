@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testSymbolizer() *Symbolizer {
+	return &Symbolizer{
+		symbols: []symbolEntry{
+			{addr: 0x400d1000, size: 0x100, name: "app_main"},
+			{addr: 0x400d2000, size: 0x80, name: "blink_task"},
+		},
+		lines: []lineEntry{
+			{addr: 0x400d1000, file: "main.c", line: 10},
+			{addr: 0x400d1010, file: "main.c", line: 12},
+			{addr: 0x400d1100, end: true},
+		},
+	}
+}
+
+func TestSymbolizerLookup(t *testing.T) {
+	s := testSymbolizer()
+	tests := []struct {
+		addr uint64
+		want string
+	}{
+		{0x400d1000, "app_main at main.c:10"},
+		{0x400d1012, "app_main at main.c:12"},
+		{0x400d20ff, "??"},
+		{0x400d2010, "blink_task"},
+		{0x400d1100, "??"},
+		{0x40000000, "??"},
+	}
+	for _, tt := range tests {
+		if got := s.Describe(tt.addr); got != tt.want {
+			t.Errorf("Describe(0x%x) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	var nilSym *Symbolizer
+	if got := nilSym.Describe(0x400d1000); got != "??" {
+		t.Errorf("nil Symbolizer Describe() = %q, want ??", got)
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{
+			name:   "backtrace",
+			writes: []string{"Backtrace: 0x400d1012:0x3ffb0100 0x400d2010:0x3ffb0120\n"},
+			want: "Backtrace: 0x400d1012:0x3ffb0100 0x400d2010:0x3ffb0120\n" +
+				"0x400d1012: app_main at main.c:12\n0x400d2010: blink_task\n",
+		},
+		{
+			name:   "uppercase",
+			writes: []string{"PC 0X400D1000\n"},
+			want:   "PC 0X400D1000\n0X400D1000: app_main at main.c:10\n",
+		},
+		{
+			name:   "partial writes",
+			writes: []string{"PC 0x400d", "1000 A0 0x400d1000", "\n", "next"},
+			want:   "PC 0x400d1000 A0 0x400d1000\n0x400d1000: app_main at main.c:10\nnext",
+		},
+		{
+			name:   "unknown address",
+			writes: []string{"PC 0x40000000\n"},
+			want:   "PC 0x40000000\n",
+		},
+		{
+			name:   "too long",
+			writes: []string{"0x400d1000" + strings.Repeat(" ", addressFilterMaxLine) + "\n"},
+			want:   "0x400d1000" + strings.Repeat(" ", addressFilterMaxLine) + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			f := newAddressFilter(&buf, testSymbolizer)
+			for _, v := range tt.writes {
+				if n, err := f.Write([]byte(v)); n != len(v) || err != nil {
+					t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(v))
+				}
+			}
+			if buf.String() != tt.want {
+				t.Errorf("output = %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressFilterWithoutSymbols(t *testing.T) {
+	var buf bytes.Buffer
+	f := newAddressFilter(&buf, func() *Symbolizer { return nil })
+	f.Write([]byte("PC 0x400d1000\n"))
+	if want := "PC 0x400d1000\n"; buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestAddressSymbolizerCachesErrors(t *testing.T) {
+	var stderr bytes.Buffer
+	c := NewClient(&ProjectInfo{AppElf: "/nonexistent/app.elf"}, strings.NewReader(""), &bytes.Buffer{}, &stderr)
+	for ii := 0; ii < 3; ii++ {
+		if sym := c.addressSymbolizer(); sym != nil {
+			t.Fatalf("addressSymbolizer() = %v, want nil", sym)
+		}
+	}
+	if n := strings.Count(stderr.String(), "can't decode addresses"); n != 1 {
+		t.Errorf("warned %d times, want 1:\n%s", n, stderr.String())
+	}
+}
@@ -2,80 +2,122 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
+	"strings"
 	"sync"
 	"time"
-)
 
-const (
-	cmdPrintStdout   = 0
-	cmdPrintStderr   = 1
-	cmdPong          = 5
-	cmdOTAProgress   = 6
-	cmdOTASuccess    = 7
-	cmdOTAFailed     = 8
-	cmdConfig        = 9
-	cmdPing          = 128
-	cmdReboot        = 129
-	cmdOTA           = 130
-	cmdContinue      = 131
-	cmdCoredumpRead  = 132
-	cmdCoredumpErase = 133
-	cmdGetConfig     = 134
-	cmdSetConfig     = 135
+	"github.com/fiam/idf_wmonitor/protocol"
 )
 
 const (
-	otaTimeout = time.Second * 5 // Timeout between messages
+	otaTimeout   = time.Second * 5 // Timeout between messages
+	helloTimeout = time.Second * 2 // Timeout for the handshake reply
+	authTimeout  = time.Second * 5 // Timeout for authenticating the host
+	dialTimeout  = time.Second * 5 // Default timeout for connecting to each address
 )
 
-const (
-	hostConfigVersion     = 1
-	hostConfigSSIDLen     = 33
-	hostConfigPasswordLen = 64
-)
+// HostConfig is the configuration stored in the host
+type HostConfig = protocol.Config
 
 const (
-	WifiModeAuto = iota
-	WifiModeSTA
-	WifiModeAP
+	WifiModeAuto = protocol.WifiModeAuto
+	WifiModeSTA  = protocol.WifiModeSTA
+	WifiModeAP   = protocol.WifiModeAP
 )
 
-type HostConfig struct {
-	Version      uint8
-	WifiSSID     string
-	WifiPassword string
-	WifiMode     uint8
-}
-
 type Client struct {
-	Host   *Host
+	Host *Host
+	// DecodeAddresses enables printing the source location of the
+	// code addresses found in the output from the host
+	DecodeAddresses bool
+	// CoreDumpDir is the directory where coredumps retrieved
+	// from the host are archived. Empty disables archiving.
+	CoreDumpDir string
+	// MaxOTARate limits the OTA upload rate, in bytes per second.
+	// Zero means no limit other than the flow control.
+	MaxOTARate int
+	// OTAProgressStep makes the OTA progress be printed on its own
+	// line every OTAProgressStep percent, rather than updating the
+	// same line. Zero updates the same line.
+	OTAProgressStep int
+	// DialTimeout is the timeout for connecting to each address
+	// of the host. Zero uses a default timeout.
+	DialTimeout time.Duration
+	// CompressOTA enables compressing OTA chunks, if the
+	// host supports it
+	CompressOTA bool
+	// Keys contains the pre-shared keys used to authenticate the
+	// hosts. When a host has a key, the connection is encrypted and
+	// the client refuses to talk to it unless it authenticates.
+	Keys HostKeys
+	// SigningKey is used to sign OTA images, if the host supports
+	// it. Nil disables signing.
+	SigningKey ed25519.PrivateKey
+	// IgnoreCoreDumps disables retrieving the coredump stored in
+	// the host after connecting. Use FetchCoreDump instead.
+	IgnoreCoreDumps bool
+
 	info   *ProjectInfo
-	conn   net.Conn
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
 
-	mu             sync.Mutex
-	timeouts       int
-	otaSize        int
-	otaLastMessage time.Time
-
-	onConfig func(*HostConfig)
+	// mu serializes the writes to the connection
+	mu sync.Mutex
+
+	// stateMu guards the fields shared between Run() and the
+	// methods called from other goroutines. It may be acquired
+	// while holding mu, but not the other way around.
+	stateMu sync.Mutex
+	// host is the Host used by the last call to Connect()
+	host       *Host
+	conn       net.Conn
+	connGen    int
+	ota        *otaTransfer
+	deviceInfo *protocol.InfoFrame
+	// requests contains the requests waiting for a
+	// reply, in the order they were sent
+	requests []*pendingRequest
+	// changed is closed when the connection or the
+	// handshake state change, see waitFor()
+	changed chan struct{}
+
+	// Only used by Connect() and Run()
+	timeouts  int
+	helloSent time.Time
+	// logBufs contain the incomplete lines printed by the host
+	// to stdout and stderr, for emitting LogLine events
+	logBufs [2][]byte
+
+	events eventHandlers
+
+	symMu     sync.Mutex
+	sym       *Symbolizer
+	symWarned bool
+	// symChecked is the last time addressSymbolizer
+	// checked the app ELF
+	symChecked time.Time
+
+	stdoutFilter *addressFilter
+	stderrFilter *addressFilter
 }
 
 func NewClient(info *ProjectInfo, stdin io.Reader, stdout io.Writer, stderr io.Writer) *Client {
-	return &Client{
+	c := &Client{
 		info:   info,
 		stdin:  stdin,
 		stdout: stdout,
 		stderr: stderr,
 	}
+	c.stdoutFilter = newAddressFilter(stdout, c.addressSymbolizer)
+	c.stderrFilter = newAddressFilter(stderr, c.addressSymbolizer)
+	return c
 }
 
 func (c *Client) ProjectInfo() *ProjectInfo {
@@ -90,48 +132,250 @@ func (c *Client) Stdout() io.Writer {
 	return c.stdout
 }
 
-func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.Host.Addr)
+// Connect connects to c.Host and starts the handshake. Run must be
+// called afterwards to process the messages from the host. The context
+// only applies to establishing the connection.
+func (c *Client) Connect(ctx context.Context) error {
+	c.stateMu.Lock()
+	c.host = c.Host
+	c.stateMu.Unlock()
+	conn, err := c.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("error connecting to %s: %v", c.Host.Host, err)
+		return err
+	}
+	if key := c.Keys.Lookup(c.Host.Host); key != nil {
+		sconn, err := authenticate(ctx, conn, key)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("error authenticating %s: %v", c.Host.Host, err)
+		}
+		conn = sconn
 	}
-	c.conn = conn
 	c.timeouts = 0
-	c.otaSize = 0
-	// First, try to find a coredump so we can retrieve it
-	// before the host crashes again
-	c.writeByte(cmdCoredumpRead)
+	c.stateMu.Lock()
+	c.conn = conn
+	c.connGen++
+	c.deviceInfo = nil
+	t := c.ota
+	c.failRequestsLocked()
+	c.notifyLocked()
+	c.stateMu.Unlock()
+	if t != nil && !t.chunked {
+		// Only chunked transfers can be resumed
+		c.finishOTA(t, errOTAInterrupted)
+	}
+	// Ask the host about its capabilities. Run() will continue
+	// once it replies or the handshake times out.
+	c.helloSent = time.Now()
+	return c.send(&protocol.HelloFrame{})
+}
+
+// hostName returns the name of the host used by the last call to
+// Connect(). Unlike c.Host, it can be used while Run() is running
+// in another goroutine.
+func (c *Client) hostName() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	if c.host == nil {
+		return ""
+	}
+	return c.host.Host
+}
+
+// notifyLocked wakes up the goroutines blocked in waitFor(). It must
+// be called with stateMu held after changing the connection state.
+func (c *Client) notifyLocked() {
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// waitFor blocks until cond, which is called with stateMu held,
+// returns true. It returns ctx.Err() if ctx is done first.
+func (c *Client) waitFor(ctx context.Context, cond func() bool) error {
+	for {
+		c.stateMu.Lock()
+		if cond() {
+			c.stateMu.Unlock()
+			return nil
+		}
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.stateMu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// dial connects to the first reachable address of the host
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	if len(c.Host.Addrs) == 0 {
+		return nil, fmt.Errorf("host %s has no addresses", c.Host.Host)
+	}
+	timeout := c.DialTimeout
+	if timeout <= 0 {
+		timeout = dialTimeout
+	}
+	var errs []string
+	for _, addr := range c.Host.Addrs {
+		d := &net.Dialer{Timeout: timeout}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("error connecting to %s: %s", c.Host.Host, strings.Join(errs, "; "))
+}
+
+// authenticate performs the authentication handshake with the host and
+// returns a connection which encrypts all the data.
+func authenticate(ctx context.Context, conn net.Conn, key []byte) (net.Conn, error) {
+	deadline := time.Now().Add(authTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	// Interrupt the handshake if ctx is canceled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	sconn, err := protocol.ClientHandshake(conn, key)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, errors.New("host did not reply, it might not have a key configured")
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return sconn, nil
+}
+
+// DeviceInfo returns the information reported by the host during
+// the handshake, or nil if the handshake hasn't finished yet.
+func (c *Client) DeviceInfo() *protocol.InfoFrame {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.deviceInfo
+}
+
+func (c *Client) setDeviceInfo(info *protocol.InfoFrame) {
+	c.stateMu.Lock()
+	c.deviceInfo = info
+	c.notifyLocked()
+	c.stateMu.Unlock()
+	features := []struct {
+		cmd  byte
+		name string
+	}{
+		{protocol.CmdCoredumpRead, "coredumps"},
+		{protocol.CmdGetConfig, "configuration"},
+		{protocol.CmdOTA, "OTA updates"},
+		{protocol.CmdReboot, "rebooting"},
+	}
+	for _, v := range features {
+		if !info.Supports(v.cmd) {
+			fmt.Fprintf(c.stdout, "host %s does not support %s, disabling\n", c.hostName(), v.name)
+		}
+	}
+	if info.Supports(protocol.CmdCoredumpRead) && !c.IgnoreCoreDumps {
+		// First, try to find a coredump so we can retrieve it
+		// before the host crashes again
+		c.send(&protocol.CoredumpReadFrame{})
+	}
+}
+
+// checkSupported returns an error if the host does not support
+// the given command
+func (c *Client) checkSupported(cmd byte) error {
+	return c.checkInfoSupports(c.DeviceInfo(), cmd)
+}
+
+// checkInfoSupports is like checkSupported, but checks the given info,
+// which might be nil before the handshake. Use it when the info is
+// used after the check, since reconnecting resets it.
+func (c *Client) checkInfoSupports(info *protocol.InfoFrame, cmd byte) error {
+	if info == nil {
+		return errors.New("handshake with host not finished yet")
+	}
+	if !info.Supports(cmd) {
+		return fmt.Errorf("host %s does not support %s", c.hostName(), protocol.CommandName(cmd))
+	}
 	return nil
 }
 
 func (c *Client) Close() error {
-	if c.conn != nil {
-		conn := c.conn
-		// Set to nil here, so Run() can detect that we
-		// closed the connection intentionally
-		c.conn = nil
+	c.stateMu.Lock()
+	conn := c.conn
+	// Set to nil here, so Run() can detect that we
+	// closed the connection intentionally
+	c.conn = nil
+	c.failRequestsLocked()
+	c.notifyLocked()
+	c.stateMu.Unlock()
+	if conn != nil {
 		if err := conn.Close(); err != nil {
-			c.conn = conn
+			c.stateMu.Lock()
+			if c.conn == nil {
+				c.conn = conn
+			}
+			c.stateMu.Unlock()
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) isFlashingOTA() bool {
-	return c.otaSize > 0 && time.Since(c.otaLastMessage) < otaTimeout
+// connection returns the current connection, nil if
+// not connected
+func (c *Client) connection() net.Conn {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.conn
 }
 
 func (c *Client) write(data []byte) error {
+	return c.writeRate(context.Background(), data, 0)
+}
+
+// writeRate writes data to the host, limiting the throughput to
+// rate bytes per second. A zero rate disables rate limiting. When
+// rate limiting, it stops writing if ctx is done.
+func (c *Client) writeRate(ctx context.Context, data []byte, rate int) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	var err error
-	conn := c.conn
+	conn := c.connection()
 	if conn != nil {
-		// Don't write more than 100K/s, otherwise the ESP32
-		// might drop packets
-		blocksize := 100 * 1024
-		interval := 1000 * time.Millisecond
+		if rate <= 0 {
+			_, err = conn.Write(data)
+			return err
+		}
+		// Write in blocks of 1/10th of the rate, sleeping only
+		// as much as required to stay under it
+		blocksize := rate / 10
+		if blocksize < 1 {
+			blocksize = 1
+		}
+		start := time.Now()
 		for pos := 0; pos < len(data); pos += blocksize {
 			end := pos + blocksize
 			if end > len(data) {
@@ -140,10 +384,20 @@ func (c *Client) write(data []byte) error {
 			if _, err = conn.Write(data[pos:end]); err != nil {
 				return err
 			}
-			if pos < len(data) {
-				time.Sleep(interval)
+			if end < len(data) {
+				expected := time.Duration(end) * time.Second / time.Duration(rate)
+				if d := expected - time.Since(start); d > 0 {
+					select {
+					case <-time.After(d):
+					case <-ctx.Done():
+						// The host can't tell the rest of the stream
+						// apart from the truncated frame, start over
+						// with a new connection
+						conn.Close()
+						return ctx.Err()
+					}
+				}
 			}
-
 		}
 	} else {
 		err = errors.New("not connected")
@@ -151,56 +405,22 @@ func (c *Client) write(data []byte) error {
 	return err
 }
 
-func (c *Client) writeByte(b byte) error {
-	return c.write([]byte{b})
-}
-
-func (c *Client) print(conn net.Conn, w io.Writer) error {
-	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	var s uint32
-	if err := binary.Read(conn, binary.BigEndian, &s); err != nil {
-		return err
-	}
-	data := make([]byte, int(s))
-	if _, err := io.ReadFull(conn, data); err != nil {
+func (c *Client) send(f protocol.Frame) error {
+	var buf bytes.Buffer
+	if err := protocol.Encode(&buf, f); err != nil {
 		return err
 	}
-	if w != nil && !c.isFlashingOTA() {
-		fmt.Fprint(w, string(data))
-	}
-	return nil
+	return c.write(buf.Bytes())
 }
 
-func (c *Client) readBlob(conn net.Conn, size interface{}) ([]byte, error) {
-	conn.SetReadDeadline(time.Now().Add(time.Second))
-	if err := binary.Read(conn, binary.BigEndian, size); !c.handleError(err) {
-		return nil, err
-	}
-	var blobSize int
-	switch x := size.(type) {
-	case *uint16:
-		blobSize = int(*x)
-	case *uint32:
-		blobSize = int(*x)
-	default:
-		panic(fmt.Errorf("invalid blob length type %T", size))
-	}
-	data := make([]byte, blobSize)
-	conn.SetReadDeadline(time.Now().Add(time.Second))
-	if _, err := io.ReadFull(conn, data); !c.handleError(err) {
-		return nil, err
+func (c *Client) print(w io.Writer, filter *addressFilter, data []byte) {
+	if w != nil && !c.isFlashingOTA() {
+		if c.DecodeAddresses {
+			filter.Write(data)
+		} else {
+			w.Write(data)
+		}
 	}
-	return data, nil
-}
-
-func (c *Client) readBlob32(conn net.Conn) ([]byte, error) {
-	var size uint32
-	return c.readBlob(conn, &size)
-}
-
-func (c *Client) readBlob16(conn net.Conn) ([]byte, error) {
-	var size uint16
-	return c.readBlob(conn, &size)
 }
 
 func (c *Client) handleError(err error) bool {
@@ -211,7 +431,7 @@ func (c *Client) handleError(err error) bool {
 					return true
 				}
 				c.timeouts++
-				c.writeByte(cmdPing)
+				c.send(&protocol.PingFrame{})
 				return true
 			}
 		}
@@ -220,49 +440,84 @@ func (c *Client) handleError(err error) bool {
 	return true
 }
 
-func (c *Client) GetConfig(f func(*HostConfig)) error {
-	c.onConfig = f
-	return c.writeByte(cmdGetConfig)
+// GetConfig retrieves the configuration stored in the host
+func (c *Client) GetConfig(ctx context.Context) (*HostConfig, error) {
+	if err := c.checkSupported(protocol.CmdGetConfig); err != nil {
+		return nil, err
+	}
+	reply, err := c.request(ctx, &protocol.GetConfigFrame{}, protocol.CmdConfig)
+	if err != nil {
+		return nil, err
+	}
+	cfg := reply.(*protocol.ConfigFrame).Config
+	if cfg == nil {
+		cfg = &HostConfig{}
+	}
+	return cfg, nil
 }
 
-func (c *Client) SetConfig(cfg *HostConfig) error {
-	var buf bytes.Buffer
-	buf.WriteByte(cmdSetConfig)
-	size := uint16(hostConfigSSIDLen + hostConfigPasswordLen + 2)
-	if err := binary.Write(&buf, binary.BigEndian, size); err != nil {
+// SetConfig stores the given configuration in the host and, once
+// the host confirms it, reboots the host to apply it
+func (c *Client) SetConfig(ctx context.Context, cfg *HostConfig) error {
+	if err := c.checkSupported(protocol.CmdSetConfig); err != nil {
 		return err
 	}
-	buf.WriteByte(hostConfigVersion)
-	ssidData := []byte(cfg.WifiSSID)
-	for len(ssidData) < hostConfigSSIDLen {
-		ssidData = append(ssidData, 0)
+	if _, err := c.request(ctx, &protocol.SetConfigFrame{Config: cfg}, protocol.CmdConfig); err != nil {
+		return err
 	}
-	buf.Write(ssidData)
-	passwordData := []byte(cfg.WifiPassword)
-	for len(passwordData) < hostConfigPasswordLen {
-		passwordData = append(passwordData, 0)
+	return c.Reboot(ctx)
+}
+
+// WaitHandshake blocks until the handshake with the host has
+// finished or ctx is done
+func (c *Client) WaitHandshake(ctx context.Context) error {
+	err := c.waitFor(ctx, func() bool { return c.deviceInfo != nil })
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("timed out waiting for handshake with %s", c.hostName())
 	}
-	buf.Write(passwordData)
-	buf.WriteByte(byte(cfg.WifiMode))
-	return c.write(buf.Bytes())
+	return err
+}
+
+// Run processes the messages from the host until the connection is
+// lost, returning the error that caused it. It returns nil if Close
+// is called, or ctx.Err() if ctx is done, which also closes the
+// connection. A Disconnected event is emitted before returning.
+func (c *Client) Run(ctx context.Context) error {
+	err := c.run(ctx)
+	c.flushOutput()
+	c.emit(&Disconnected{Host: c.hostName(), Err: err})
+	return err
 }
 
-func (c *Client) Run() error {
+func (c *Client) run(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
 	cmd := make([]byte, 1)
 	for {
-		conn := c.conn
+		conn := c.connection()
 		if conn == nil {
 			// Closed() was called
-			break
+			return ctx.Err()
+		}
+		if c.DeviceInfo() == nil && time.Since(c.helloSent) > helloTimeout {
+			fmt.Fprintf(c.stdout, "host %s did not reply to handshake, assuming legacy firmware\n", c.hostName())
+			c.setDeviceInfo(protocol.LegacyInfo())
 		}
 		// We want to fail fast here, so we can reconnect quickly
 		// if the host crashes
 		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
 		_, err := conn.Read(cmd)
 		if err != nil {
-			if c.conn == nil {
+			if c.connection() == nil {
 				// Closed intentionally
-				break
+				return ctx.Err()
 			}
 			if c.handleError(err) {
 				continue
@@ -270,124 +525,107 @@ func (c *Client) Run() error {
 			return err
 		}
 		c.timeouts = 0
-		switch cmd[0] {
-		case cmdPrintStdout:
-			if err := c.print(conn, c.stdout); !c.handleError(err) {
-				return err
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		frame, err := protocol.DecodeFrame(cmd[0], conn)
+		if err != nil {
+			if uerr, ok := err.(*protocol.UnknownCommandError); ok {
+				fmt.Fprintf(c.stderr, "host %s sent unknown command %v, it might be running a newer protocol version than %d\n",
+					c.hostName(), uerr.Cmd, protocol.Version)
+				continue
 			}
-		case cmdPrintStderr:
-			if err := c.print(conn, c.stderr); !c.handleError(err) {
-				return err
+			if c.connection() == nil {
+				return ctx.Err()
 			}
-		case cmdPong:
+			// Part of the frame has already been read, so a timeout
+			// here doesn't mean the host is idle and the stream can't
+			// be resynchronized
+			return err
+		}
+		if f, ok := frame.(*protocol.ConfigFrame); ok {
+			// Copy it, since GetConfig callers might modify theirs
+			var cfg HostConfig
+			if f.Config != nil {
+				cfg = *f.Config
+			}
+			c.emit(&ConfigReceived{Host: c.hostName(), Config: &cfg})
+		}
+		if f, ok := frame.(*protocol.CoredumpFrame); ok && len(f.Data) > 0 {
+			c.emit(&CoredumpAvailable{Host: c.hostName(), Data: f.Data})
+		}
+		if c.deliverReply(frame) {
+			continue
+		}
+		switch f := frame.(type) {
+		case *protocol.PrintFrame:
+			c.emitOutput(f.Stderr, f.Data)
+			if f.Stderr {
+				c.print(c.stderr, c.stderrFilter, f.Data)
+			} else {
+				c.print(c.stdout, c.stdoutFilter, f.Data)
+			}
+		case *protocol.PongFrame:
 			// Nothing do to
-		case cmdOTAProgress:
-			if !c.isFlashingOTA() {
-				break
+		case *protocol.AuthRequiredFrame:
+			return fmt.Errorf("host %s requires authentication, add its key to the keys file", c.hostName())
+		case *protocol.InfoFrame:
+			fmt.Fprintf(c.stdout, "host %s is running firmware %q (protocol version %d)\n",
+				c.hostName(), f.FirmwareVersion, f.ProtocolVersion)
+			c.setDeviceInfo(f)
+		case *protocol.OTAProgressFrame:
+			if t := c.currentOTA(); t != nil {
+				c.otaProgress(t, f.Offset)
 			}
-			var offset uint32
-			conn.SetReadDeadline(time.Now().Add(time.Second))
-			if err := binary.Read(conn, binary.BigEndian, &offset); !c.handleError(err) {
-				return err
+		case *protocol.OTADigestFrame:
+			if t := c.currentOTA(); t != nil {
+				c.checkOTADigest(t, f.Digest)
 			}
-			percentage := int(offset) * 100 / c.otaSize
-			fmt.Fprintf(c.stdout, "OTA progress (%v/%v) (%d%%)\r", offset, c.otaSize, percentage)
-			c.otaLastMessage = time.Now()
-		case cmdOTAFailed:
-			if !c.isFlashingOTA() {
-				break
+		case *protocol.OTASignatureInvalidFrame:
+			if t := c.currentOTA(); t != nil {
+				c.rejectOTASignature(t)
 			}
-			fmt.Fprintf(c.stdout, "OTA failed\n")
-			c.otaSize = 0
-		case cmdOTASuccess:
-			if !c.isFlashingOTA() {
-				break
+		case *protocol.OTAFailedFrame:
+			if t := c.currentOTA(); t != nil {
+				c.finishOTA(t, ErrOTAFailed)
 			}
-			fmt.Fprintf(c.stdout, "OTA finished\n")
-			c.otaSize = 0
-		case cmdContinue:
-			fmt.Fprintf(c.stdout, "host was awaiting for us and has now continued...\n")
-		case cmdCoredumpRead:
-			data, err := c.readBlob32(conn)
-			if err != nil {
-				return err
+		case *protocol.OTASuccessFrame:
+			if t := c.currentOTA(); t != nil {
+				c.finishOTA(t, nil)
 			}
-			if len(data) == 0 {
+		case *protocol.ContinueFrame:
+			fmt.Fprintf(c.stdout, "host was awaiting for us and has now continued...\n")
+		case *protocol.CoredumpFrame:
+			if len(f.Data) == 0 {
 				// No coredump, just continue
-				c.writeByte(cmdContinue)
+				c.send(&protocol.ContinueFrame{})
 				break
 			}
-			fmt.Fprintf(c.stdout, "Found a coredump of %v bytes, retrieving...\n", len(data))
-			del, err := c.DisplayCoreDump(data)
+			fmt.Fprintf(c.stdout, "Found a coredump of %v bytes, retrieving...\n", len(f.Data))
+			c.archiveCoreDump(f.Data)
+			del, err := c.DisplayCoreDump(f.Data)
 			if err != nil {
 				fmt.Fprintf(c.stderr, "Error displaying coredump: %v\n", err)
 			}
 			if del {
-				c.writeByte(cmdCoredumpErase)
+				c.send(&protocol.CoredumpEraseFrame{})
 			} else {
-				c.writeByte(cmdContinue)
+				c.send(&protocol.ContinueFrame{})
 			}
-		case cmdCoredumpErase:
+		case *protocol.CoredumpEraseFrame:
 			// Coredump is now erased, instruct the host to continue
-			c.writeByte(cmdContinue)
-		case cmdConfig:
-			var size uint16
-			conn.SetReadDeadline(time.Now().Add(time.Second))
-			if err := binary.Read(conn, binary.BigEndian, &size); !c.handleError(err) {
-				return err
-			}
-			var cfg HostConfig
-			if size > 0 {
-				if err := binary.Read(conn, binary.BigEndian, &cfg.Version); !c.handleError(err) {
-					return err
-				}
-
-				ssidData := make([]byte, hostConfigSSIDLen)
-				if _, err := io.ReadFull(conn, ssidData); !c.handleError(err) {
-					return err
-				}
-				cfg.WifiSSID = string(bytes.Trim(ssidData, "\x00"))
-
-				passwordData := make([]byte, hostConfigPasswordLen)
-				if _, err := io.ReadFull(conn, passwordData); !c.handleError(err) {
-					return err
-				}
-				cfg.WifiPassword = string(bytes.Trim(passwordData, "\x00"))
-
-				if err := binary.Read(conn, binary.BigEndian, &cfg.WifiMode); !c.handleError(err) {
-					return err
-				}
-			}
-			onConfig := c.onConfig
-			if onConfig != nil {
-				onConfig(&cfg)
-			} else {
-				// We're probably getting it as a response to setting the config, apply it
-				c.Reboot()
-			}
-			c.onConfig = nil
-		default:
-			fmt.Fprintf(c.stderr, "unknown command %v\n", cmd[0])
+			c.send(&protocol.ContinueFrame{})
 		}
 	}
-	return nil
 }
 
-func (c *Client) Reboot() error {
-	fmt.Fprintf(c.stdout, "rebooting %s...\n", c.Host.Host)
-	return c.writeByte(cmdReboot)
-}
-
-func (c *Client) Flash(bin string) error {
-	data, err := ioutil.ReadFile(bin)
-	if err != nil {
+// Reboot asks the host to reboot. It doesn't wait for the host
+// to come back.
+func (c *Client) Reboot(ctx context.Context) error {
+	if err := c.checkSupported(protocol.CmdReboot); err != nil {
 		return err
 	}
-	c.otaSize = len(data)
-	c.otaLastMessage = time.Now()
-	var buf bytes.Buffer
-	buf.WriteByte(cmdOTA)
-	binary.Write(&buf, binary.BigEndian, uint32(len(data)))
-	buf.Write(data)
-	return c.write(buf.Bytes())
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "rebooting %s...\n", c.hostName())
+	return c.send(&protocol.RebootFrame{})
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// lockedBuffer is a bytes.Buffer which can be written
+// by the client while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testClient is a Client connected to a fake device, with Run
+// running in its own goroutine
+type testClient struct {
+	*Client
+	stdout lockedBuffer
+	stderr lockedBuffer
+	done   chan error
+}
+
+// startDevice starts listening on a random local port with d,
+// which must be configured before calling it
+func startDevice(t *testing.T, d *fakedevice.Device) *fakedevice.Device {
+	t.Helper()
+	if err := d.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// connectClient connects a new client to the device and waits for the
+// handshake. If setup is not nil, it's called before connecting.
+func connectClient(t *testing.T, d *fakedevice.Device, setup func(c *Client)) *testClient {
+	t.Helper()
+	tc := &testClient{done: make(chan error, 1)}
+	tc.Client = NewClient(&ProjectInfo{}, strings.NewReader(""), &tc.stdout, &tc.stderr)
+	tc.Host = &Host{Host: d.Name, Addrs: []string{d.Addr()}}
+	if setup != nil {
+		setup(tc.Client)
+	}
+	if err := tc.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	tc.run()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tc.WaitHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func (tc *testClient) run() {
+	go func() {
+		tc.done <- tc.Run(context.Background())
+	}()
+}
+
+// wait waits for Run to return
+func (tc *testClient) wait(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-tc.done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Run to return")
+		return nil
+	}
+}
+
+// close closes the client and waits for Run to return
+func (tc *testClient) close(t *testing.T) {
+	t.Helper()
+	tc.Close()
+	if err := tc.wait(t); err != nil {
+		t.Errorf("Run() = %v after Close(), want nil", err)
+	}
+}
+
+// reconnect connects the client again each time the connection is
+// lost, like the monitor does. It stops when the client is closed
+// or it can't connect, closing the returned channel.
+func (tc *testClient) reconnect() <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			if err := <-tc.done; err == nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			if err := tc.Connect(context.Background()); err != nil {
+				return
+			}
+			tc.run()
+		}
+	}()
+	return stopped
+}
+
+func testImage(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	// Make it compressible
+	for ii := 0; ii < size; ii += 3 {
+		data[ii] = 0
+	}
+	return data
+}
+
+func TestClientOutput(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	c := connectClient(t, d, nil)
+	defer c.close(t)
+	d.Printf("hello %d\n", 42)
+	d.Eprintf("error\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(c.stdout.String(), "hello 42\n") || !strings.Contains(c.stderr.String(), "error\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("stdout = %q, stderr = %q", c.stdout.String(), c.stderr.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientFlash(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  func(d *fakedevice.Device)
+		client  func(c *Client)
+		wantErr func(err error) bool
+		flashed bool
+	}{
+		{name: "chunked", flashed: true},
+		{
+			name:    "compressed",
+			client:  func(c *Client) { c.CompressOTA = true },
+			flashed: true,
+		},
+		{
+			name:    "legacy",
+			device:  func(d *fakedevice.Device) { d.Legacy = true },
+			flashed: true,
+		},
+		{
+			name: "verified without chunks",
+			device: func(d *fakedevice.Device) {
+				d.Commands = []byte{protocol.CmdPing, protocol.CmdOTA, protocol.CmdHello, protocol.CmdOTAVerified}
+			},
+			flashed: true,
+		},
+		{
+			name:    "failed",
+			device:  func(d *fakedevice.Device) { d.FailOTA = true },
+			wantErr: func(err error) bool { return err == ErrOTAFailed },
+		},
+		{
+			name:   "corrupted",
+			device: func(d *fakedevice.Device) { d.CorruptOTA = true },
+			wantErr: func(err error) bool {
+				_, ok := err.(*OTADigestMismatchError)
+				return ok
+			},
+		},
+		{
+			name: "authenticated",
+			device: func(d *fakedevice.Device) {
+				d.Key = []byte("0123456789abcdef")
+			},
+			client: func(c *Client) {
+				c.Keys = HostKeys{"dev": []byte("0123456789abcdef")}
+			},
+			flashed: true,
+		},
+	}
+	image := testImage(100000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := fakedevice.New("dev")
+			if tt.device != nil {
+				tt.device(d)
+			}
+			startDevice(t, d)
+			defer d.Close()
+			c := connectClient(t, d, tt.client)
+			defer c.close(t)
+			err := c.Flash(context.Background(), bytes.NewReader(image))
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Errorf("Flash() = %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Flash() = %v, want nil", err)
+			}
+			if flashed := bytes.Equal(d.Image(), image); flashed != tt.flashed {
+				t.Errorf("image flashed = %v, want %v", flashed, tt.flashed)
+			}
+		})
+	}
+}
+
+func TestClientFlashEmpty(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	c := connectClient(t, d, nil)
+	defer c.close(t)
+	if err := c.Flash(context.Background(), bytes.NewReader(nil)); err == nil {
+		t.Error("Flash() with an empty image = nil, want an error")
+	}
+	if c.currentOTA() != nil {
+		t.Error("empty image left an OTA transfer in progress")
+	}
+}
+
+// reconnectingReader connects the client again before
+// returning the image, like a reconnection would while
+// Flash reads it
+type reconnectingReader struct {
+	t     *testing.T
+	tc    *testClient
+	image io.Reader
+	done  bool
+}
+
+func (r *reconnectingReader) Read(p []byte) (int, error) {
+	if !r.done {
+		r.done = true
+		r.tc.Close()
+		r.tc.wait(r.t)
+		if err := r.tc.Connect(context.Background()); err != nil {
+			return 0, err
+		}
+		r.tc.run()
+	}
+	return r.image.Read(p)
+}
+
+func TestClientFlashWhileReconnecting(t *testing.T) {
+	image := testImage(50000)
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	c := connectClient(t, d, nil)
+	defer c.close(t)
+	r := &reconnectingReader{t: t, tc: c, image: bytes.NewReader(image)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The handshake might not have finished when flashing starts,
+	// it must use the info from the previous connection
+	if err := c.Flash(ctx, r); err != nil {
+		t.Fatalf("Flash() = %v, want nil", err)
+	}
+	if !bytes.Equal(d.Image(), image) {
+		t.Error("image was not flashed")
+	}
+}
+
+func TestClientFlashRetries(t *testing.T) {
+	image := testImage(50000)
+	f, err := ioutil.TempFile("", "app.*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(image)
+	f.Close()
+
+	d := fakedevice.New("dev")
+	d.FailOTACount = 2
+	startDevice(t, d)
+	defer d.Close()
+	c := connectClient(t, d, nil)
+	defer c.close(t)
+	attempts, err := flashWithRetries(context.Background(), c.Client, f.Name(), 2)
+	if err != nil || attempts != 3 {
+		t.Fatalf("flashWithRetries() = %d, %v, want 3, nil", attempts, err)
+	}
+	if !bytes.Equal(d.Image(), image) {
+		t.Error("image was not flashed")
+	}
+}
+
+func TestClientFlashResume(t *testing.T) {
+	image := testImage(250000)
+	d := fakedevice.New("dev")
+	d.DisconnectOTAAt = 120000
+	startDevice(t, d)
+	c := connectClient(t, d, nil)
+	stopped := c.reconnect()
+	err := c.Flash(context.Background(), bytes.NewReader(image))
+	d.Close()
+	<-stopped
+	c.Close()
+	if err != nil {
+		t.Fatalf("Flash() = %v, want nil", err)
+	}
+	if !bytes.Equal(d.Image(), image) {
+		t.Error("image was not flashed")
+	}
+	if !strings.Contains(c.stdout.String(), "resum") {
+		t.Errorf("transfer was not resumed, output: %q", c.stdout.String())
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	d := fakedevice.New("dev")
+	d.SetConfig(&protocol.Config{Version: protocol.ConfigVersion, WifiSSID: "old", WifiMode: WifiModeAP})
+	startDevice(t, d)
+	defer d.Close()
+	c := connectClient(t, d, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg, err := c.GetConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WifiSSID != "old" || cfg.WifiMode != WifiModeAP {
+		t.Errorf("GetConfig() = %+v", cfg)
+	}
+	cfg.WifiSSID = "new"
+	cfg.WifiPassword = "password"
+	cfg.WifiMode = WifiModeSTA
+	if err := c.SetConfig(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	// Setting the configuration reboots the host
+	if err := c.wait(t); err == nil {
+		t.Error("Run() = nil after reboot, want an error")
+	}
+	c.Close()
+	if got := d.Config(); !reflect.DeepEqual(got, cfg) {
+		t.Errorf("device config = %+v, want %+v", got, cfg)
+	}
+	if n := d.Reboots(); n != 1 {
+		t.Errorf("device rebooted %d times, want 1", n)
+	}
+}
+
+func TestClientReboot(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	c := connectClient(t, d, nil)
+	if err := c.Reboot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.wait(t); err == nil {
+		t.Error("Run() = nil after reboot, want an error")
+	}
+	c.Close()
+	if n := d.Reboots(); n != 1 {
+		t.Errorf("device rebooted %d times, want 1", n)
+	}
+}
+
+func TestClientAuthRequired(t *testing.T) {
+	d := fakedevice.New("dev")
+	d.Key = []byte("0123456789abcdef")
+	startDevice(t, d)
+	defer d.Close()
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), ioutil.Discard, ioutil.Discard)
+	c.Host = &Host{Host: d.Name, Addrs: []string{d.Addr()}}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err := c.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "requires authentication") {
+		t.Errorf("Run() = %v, want authentication error", err)
+	}
+}
+
+func TestClientAuthenticated(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	d := fakedevice.New("dev")
+	d.Key = key
+	d.SetConfig(&protocol.Config{Version: protocol.ConfigVersion, WifiSSID: "ssid", WifiMode: WifiModeSTA})
+	startDevice(t, d)
+	defer d.Close()
+	c := connectClient(t, d, func(c *Client) {
+		// Keys are looked up by the normalized host name
+		c.Keys = HostKeys{normalizeHostName("dev.local."): key}
+	})
+	defer c.close(t)
+	c.stateMu.Lock()
+	_, secure := c.conn.(*protocol.SecureConn)
+	c.stateMu.Unlock()
+	if !secure {
+		t.Fatal("authenticated connection is not encrypted")
+	}
+	d.Printf("hello %d\n", 42)
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(c.stdout.String(), "hello 42\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("stdout = %q", c.stdout.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cfg, err := c.GetConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WifiSSID != "ssid" {
+		t.Errorf("GetConfig() = %+v", cfg)
+	}
+}
+
+func TestClientAuthWrongKey(t *testing.T) {
+	d := fakedevice.New("dev")
+	d.Key = []byte("0123456789abcdef")
+	startDevice(t, d)
+	defer d.Close()
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), ioutil.Discard, ioutil.Discard)
+	c.Host = &Host{Host: d.Name, Addrs: []string{d.Addr()}}
+	c.Keys = HostKeys{"*": []byte("fedcba9876543210")}
+	err := c.Connect(context.Background())
+	if err == nil {
+		c.Close()
+		t.Fatal("Connect() with the wrong key = nil, want an error")
+	}
+	if !strings.Contains(err.Error(), protocol.ErrAuthFailed.Error()) {
+		t.Errorf("Connect() = %v, want %v", err, protocol.ErrAuthFailed)
+	}
+}
+
+func TestClientCoreDump(t *testing.T) {
+	coredump := append([]byte{0xE5, 0xE5, 0xE5, 0xE5}, testImage(1000)...)
+	for _, erase := range []bool{false, true} {
+		d := fakedevice.New("dev")
+		d.SetCoredump(coredump)
+		startDevice(t, d)
+		c := connectClient(t, d, func(c *Client) { c.IgnoreCoreDumps = true })
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		data, erased, err := c.FetchCoreDump(ctx, erase)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, coredump) || erased != erase {
+			t.Errorf("erase = %v: got %d bytes, erased = %v", erase, len(data), erased)
+		}
+		if stored := d.Coredump(); (stored == nil) != erase {
+			t.Errorf("erase = %v: device still has coredump = %v", erase, stored != nil)
+		}
+		c.close(t)
+		d.Close()
+	}
+}
+
+func TestClientNoCoreDump(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	c := connectClient(t, d, func(c *Client) { c.IgnoreCoreDumps = true })
+	defer c.close(t)
+	data, erased, err := c.FetchCoreDump(context.Background(), true)
+	if data != nil || erased || err != nil {
+		t.Errorf("FetchCoreDump() = %v, %v, %v, want nil, false, nil", data, erased, err)
+	}
+}
+
+func TestClientPartialFrame(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Send the command and half of the length, then stall
+		conn.Write([]byte{protocol.CmdPrintStdout, 0})
+		time.Sleep(10 * time.Second)
+	}()
+
+	var stdout, stderr lockedBuffer
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), &stdout, &stderr)
+	c.Host = &Host{Host: "partial", Addrs: []string{ln.Addr().String()}}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Run() = nil, want an error")
+		}
+	case <-time.After(6 * time.Second):
+		t.Fatal("Run() didn't return after a timeout in the middle of a frame")
+	}
+}
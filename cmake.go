@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	projectDescriptionFile = "project_description.json"
+)
+
+// projectDescription contains the fields we need from the
+// project_description.json generated by the ESP-IDF CMake build
+type projectDescription struct {
+	ProjectPath string `json:"project_path"`
+	BuildDir    string `json:"build_dir"`
+	AppElf      string `json:"app_elf"`
+	AppBin      string `json:"app_bin"`
+	IDFPath     string `json:"idf_path"`
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// isCMakeProject returns true if the project at the given path should be
+// built with CMake. Projects which have been configured with CMake or
+// which don't have a Makefile are considered CMake projects.
+func isCMakeProject(projectPath string, buildDir string, makefile string) bool {
+	if fileExists(filepath.Join(buildDir, projectDescriptionFile)) {
+		return true
+	}
+	return fileExists(filepath.Join(projectPath, "CMakeLists.txt")) &&
+		!fileExists(filepath.Join(projectPath, makefile))
+}
+
+// ReadProjectDescription reads the project_description.json from the given
+// build directory. If it doesn't exist, the project is configured first
+// using idf.py.
+func ReadProjectDescription(projectPath string, buildDir string) (*projectDescription, error) {
+	descPath := filepath.Join(buildDir, projectDescriptionFile)
+	if !fileExists(descPath) {
+		// idf.py runs in projectPath, so a relative buildDir
+		// would be resolved against it a second time
+		absBuildDir, err := filepath.Abs(buildDir)
+		if err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("idf.py", "-B", absBuildDir, "reconfigure")
+		cmd.Dir = projectPath
+		// Keep stdout for our own output, since it might be
+		// parsed, e.g. with scan -json
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("error configuring project: %v", err)
+		}
+	}
+	data, err := ioutil.ReadFile(descPath)
+	if err != nil {
+		return nil, err
+	}
+	var desc projectDescription
+	if err := json.Unmarshal(data, &desc); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", descPath, err)
+	}
+	if desc.BuildDir == "" {
+		desc.BuildDir = buildDir
+	}
+	if desc.IDFPath == "" {
+		// Older ESP-IDF versions don't include idf_path
+		desc.IDFPath = os.Getenv("IDF_PATH")
+	}
+	if desc.AppElf == "" || desc.AppBin == "" {
+		return nil, errors.New("project description is missing app_elf or app_bin")
+	}
+	// app_elf and app_bin are relative to the build directory
+	if !filepath.IsAbs(desc.AppElf) {
+		desc.AppElf = filepath.Join(desc.BuildDir, desc.AppElf)
+	}
+	if !filepath.IsAbs(desc.AppBin) {
+		desc.AppBin = filepath.Join(desc.BuildDir, desc.AppBin)
+	}
+	return &desc, nil
+}
+
+// cmakeBuildCommand returns the command used to rebuild the app in
+// a CMake project. If the project uses ninja, we invoke it directly
+// since it's faster than going through idf.py.
+func cmakeBuildCommand(info *ProjectInfo) *exec.Cmd {
+	if fileExists(filepath.Join(info.BuildDir, "build.ninja")) {
+		if ninja, err := exec.LookPath("ninja"); err == nil {
+			cmd := exec.Command(ninja, "app")
+			cmd.Dir = info.BuildDir
+			return cmd
+		}
+	}
+	cmd := exec.Command("idf.py", "-B", info.BuildDir, "app")
+	cmd.Dir = info.Path
+	return cmd
+}
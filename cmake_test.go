@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeIDFPy writes the project description to the build directory
+// passed with -B and records its arguments in args.txt
+const fakeIDFPy = `#!/bin/sh
+echo "$@" > "$(dirname "$0")/args.txt"
+mkdir -p "$2"
+echo '{"app_elf": "app.elf", "app_bin": "app.bin"}' > "$2/project_description.json"
+echo "configured"
+`
+
+func TestReadProjectDescriptionConfigures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "idf.py"), []byte(fakeIDFPy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, err := ReadProjectDescription("sub", filepath.Join("sub", "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := ioutil.ReadFile(filepath.Join(bin, "args.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildDir, err := filepath.Abs(filepath.Join("sub", "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-B " + buildDir + " reconfigure\n"; string(args) != want {
+		t.Errorf("idf.py called with %q, want %q", args, want)
+	}
+	if want := filepath.Join("sub", "build", "app.bin"); desc.AppBin != want {
+		t.Errorf("AppBin = %q, want %q", desc.AppBin, want)
+	}
+}
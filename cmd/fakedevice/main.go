@@ -0,0 +1,87 @@
+// Command fakedevice runs a simulated device which can be used
+// to test idf_wmonitor without real hardware.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+)
+
+var (
+	nameArg      = flag.String("name", "fakedevice", "Host name to advertise")
+	listenArg    = flag.String("listen", "127.0.0.1:0", "Address to listen on")
+	mdnsArg      = flag.Bool("mdns", true, "Advertise the device over mDNS")
+	coredumpArg  = flag.String("coredump", "", "File with a raw coredump to offer to clients")
+	failOTAArg   = flag.Bool("fail-ota", false, "Make all OTA updates fail")
+	failCountArg = flag.Int("fail-ota-count", 0, "Make the first N OTA updates fail")
+	corruptArg   = flag.Bool("corrupt-ota", false, "Corrupt all received OTA images")
+	versionArg   = flag.String("version", "fakedevice", "Firmware version to report")
+	legacyArg    = flag.Bool("legacy", false, "Behave like firmware without handshake support")
+	pubKeyArg    = flag.String("public-key", "", "File with the Ed25519 public key (PEM) used to verify OTA images")
+	keyArg       = flag.String("key", "", "Pre-shared key clients must authenticate with, encoded in hex")
+	intervalArg  = flag.Duration("interval", time.Second, "Interval between log lines, zero to disable")
+)
+
+func main() {
+	flag.Parse()
+
+	d := fakedevice.New(*nameArg)
+	d.FailOTA = *failOTAArg
+	d.FailOTACount = *failCountArg
+	d.CorruptOTA = *corruptArg
+	d.FirmwareVersion = *versionArg
+	d.Legacy = *legacyArg
+	if *keyArg != "" {
+		key, err := hex.DecodeString(*keyArg)
+		if err != nil {
+			panic(err)
+		}
+		d.Key = key
+	}
+	if *pubKeyArg != "" {
+		data, err := ioutil.ReadFile(*pubKeyArg)
+		if err != nil {
+			panic(err)
+		}
+		if d.PublicKey, err = fakedevice.ParsePublicKey(data); err != nil {
+			panic(err)
+		}
+	}
+	if *coredumpArg != "" {
+		data, err := ioutil.ReadFile(*coredumpArg)
+		if err != nil {
+			panic(err)
+		}
+		d.SetCoredump(data)
+	}
+	if err := d.Listen(*listenArg); err != nil {
+		panic(err)
+	}
+	defer d.Close()
+	if *mdnsArg {
+		if err := d.Advertise(); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Printf("%s listening on %s\n", *nameArg, d.Addr())
+
+	if *intervalArg > 0 {
+		go func() {
+			for ii := 0; ; ii++ {
+				time.Sleep(*intervalArg)
+				d.Printf("I (%d) fakedevice: tick %d\n", ii*int(*intervalArg/time.Millisecond), ii)
+			}
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+}
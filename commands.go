@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// Exit codes
+const (
+	exitSuccess = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// usageError is returned by commands invoked with invalid arguments
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return usageError(fmt.Sprintf(format, args...))
+}
+
+type command struct {
+	name string
+	args string
+	help string
+	// run parses the command flags from fs and runs the command
+	run func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []*command{
+	{"monitor", "[-all] [-watch [-watch-ignore patterns] [-watch-debounce duration]]", "Show the output from the host and accept commands from the keyboard (default)", runMonitor},
+	{"scan", "[-json] [-wait duration]", "List the hosts found over mDNS", runScan},
+	{"flash", "[-build=false] [-all]", "Build the app and flash it to the host, or to all the matching hosts", runFlash},
+	{"reboot", "", "Reboot the host", runReboot},
+	{"config", "get [-show-password] | set [-mode auto|sta|ap] [-ssid ssid] [-password password]", "Show or change the Wi-Fi configuration of the host", runConfig},
+	{"coredump", "list | show <id> | fetch [-erase]", "Manage the coredump archive or retrieve the coredump from the host", runCoreDump},
+	{"key", "generate | show", "Manage the key used to sign OTA images", runKey},
+}
+
+func findCommand(name string) *command {
+	for _, v := range commands {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: %s [flags] [command] [args]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, v := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", v.name, v.help)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nFlags can be given either before or after the command.\n")
+	fmt.Fprintf(w, "Exit status is %d on success, %d if the command fails and %d for usage errors.\n\nFlags:\n",
+		exitSuccess, exitFailure, exitUsage)
+	flag.PrintDefaults()
+}
+
+// newCommandFlagSet returns a FlagSet for parsing the arguments
+// after the command name. It includes all the global flags, so
+// they can be given after the command too.
+func newCommandFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\n%s\n\nFlags:\n", os.Args[0], cmd.name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// connectHost finds the host selected with -host or -addr, connects to it and
+// waits for the handshake. Messages from the client are written to
+// stderr, so stdout only contains the command output. The returned
+// channel receives the result of Client.Run().
+func connectHost(info *ProjectInfo) (*Client, <-chan error, error) {
+	if info == nil {
+		info = &ProjectInfo{Path: projectPath()}
+	}
+	c, err := newClient(info, os.Stdin, os.Stderr, os.Stderr)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.IgnoreCoreDumps = true
+	policy, err := ParseAddressPolicy(*preferArg)
+	if err != nil {
+		return nil, nil, usageError(err.Error())
+	}
+	inv, err := loadInventory()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.Host, err = directHost(policy); err != nil {
+		return nil, nil, err
+	}
+	if c.Host == nil {
+		// Subcommands might run without a terminal, so
+		// they can't ask the user to pick a host
+		s := NewScanner(*hostArg, false, os.Stdin, os.Stderr, nil)
+		s.Policy = policy
+		s.Inventory = inv
+		if c.Host, err = s.Find(*timeoutArg); err != nil {
+			return nil, nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutArg)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Run(context.Background())
+	}()
+	if err := c.WaitHandshake(ctx); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, done, nil
+}
+
+// parseArgs parses the flags in args, which might be given before,
+// after or between the positional arguments, returning the latter
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// onlyFor returns a usage error if any of the given flags, which
+// only apply to the subcommand sub, were set
+func onlyFor(fs *flag.FlagSet, sub string, names ...string) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && containsString(names, f.Name) {
+			err = usageErrorf("-%s can only be used with %s %s", f.Name, fs.Name(), sub)
+		}
+	})
+	return err
+}
+
+func noArgs(fs *flag.FlagSet, args []string) error {
+	if len(parseArgs(fs, args)) > 0 {
+		return usageErrorf("%s takes no arguments", fs.Name())
+	}
+	return nil
+}
+
+func runScan(fs *flag.FlagSet, args []string) error {
+	asJSON := fs.Bool("json", false, "Print the hosts as JSON")
+	wait := fs.Duration("wait", 2*time.Second, "Time to wait for replies")
+	if err := noArgs(fs, args); err != nil {
+		return err
+	}
+	s := NewScanner(*hostArg, false, os.Stdin, os.Stderr, nil)
+	s.Timeout = *wait
+	hosts, err := s.Lookup()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(hosts, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", data)
+	} else if len(hosts) > 0 {
+		printHosts(os.Stdout, hosts)
+	}
+	if len(hosts) == 0 {
+		return errors.New("no hosts found")
+	}
+	return nil
+}
+
+// txtColumns are the TXT fields shown in their own column by printHosts
+var txtColumns = []string{protocol.TXTFirmwareVersion, protocol.TXTChip, protocol.TXTApp, protocol.TXTUptime}
+
+func printHosts(w io.Writer, hosts []*HostInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Host\tIPv4\tIPv6\tPort\tFirmware\tChip\tApp\tUptime\tOther\n")
+	for _, v := range hosts {
+		fields := []string{v.Host, v.IPv4, v.IPv6, strconv.Itoa(v.Port)}
+		for _, k := range txtColumns {
+			value := v.TXT[k]
+			if k == protocol.TXTUptime && value != "" {
+				if secs, err := strconv.Atoi(value); err == nil {
+					value = (time.Duration(secs) * time.Second).String()
+				}
+			}
+			fields = append(fields, value)
+		}
+		var other []string
+		for k, value := range v.TXT {
+			if !containsString(txtColumns, k) {
+				other = append(other, k+"="+value)
+			}
+		}
+		sort.Strings(other)
+		fields = append(fields, strings.Join(other, " "))
+		for ii, f := range fields {
+			if f == "" {
+				fields[ii] = "-"
+			}
+		}
+		fmt.Fprintf(tw, "%s\n", strings.Join(fields, "\t"))
+	}
+	tw.Flush()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runFlash(fs *flag.FlagSet, args []string) error {
+	build := fs.Bool("build", true, "Build the app before flashing it")
+	all := fs.Bool("all", false, "Flash all the hosts matching -host and print a summary")
+	if err := noArgs(fs, args); err != nil {
+		return err
+	}
+	info, err := findProjectInfo(projectPath())
+	if err != nil {
+		return err
+	}
+	if *build {
+		cmd := info.BuildCommand()
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.New("compilation failed")
+		}
+	}
+	if *all {
+		return flashAll(info)
+	}
+	c, _, err := connectHost(info)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = flashWithRetries(context.Background(), c, info.AppBin, *otaRetriesArg)
+	return err
+}
+
+// flashAll flashes the app to all the hosts matching -host, printing
+// their output prefixed with their names and a summary at the end
+func flashAll(info *ProjectInfo) error {
+	policy, err := ParseAddressPolicy(*preferArg)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	host, err := directHost(policy)
+	if err != nil {
+		return err
+	}
+	hosts := []*Host{host}
+	if host == nil {
+		s := NewScanner(*hostArg, false, os.Stdin, os.Stderr, nil)
+		s.Policy = policy
+		s.Inventory = inv
+		if hosts, err = s.Hosts(); err != nil {
+			return err
+		}
+	}
+	if len(hosts) == 0 {
+		return errors.New("no hosts found")
+	}
+	var outMu sync.Mutex
+	targets := make([]*flashTarget, len(hosts))
+	for ii, v := range hosts {
+		w := &prefixWriter{mu: &outMu, w: os.Stderr, prefix: hostPrefix(normalizeHostName(v.Host), ii, false)}
+		c, err := newClient(info, os.Stdin, w, w)
+		if err != nil {
+			return err
+		}
+		c.IgnoreCoreDumps = true
+		c.OTAProgressStep = fleetProgressStep
+		c.Host = v
+		targets[ii] = &flashTarget{name: v.Host, client: c}
+	}
+	fmt.Fprintf(os.Stderr, "flashing %s to %d hosts...\n", filepath.Base(info.AppBin), len(targets))
+	results := flashHosts(context.Background(), targets, info.AppBin, *otaConcurrencyArg, *otaRetriesArg, func(c *Client) error {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeoutArg)
+		defer cancel()
+		if err := c.Connect(ctx); err != nil {
+			return err
+		}
+		go c.Run(context.Background())
+		return c.WaitHandshake(ctx)
+	})
+	for _, v := range targets {
+		v.client.Close()
+	}
+	if failed := printFlashSummary(os.Stdout, results); failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(results))
+	}
+	return nil
+}
+
+func runReboot(fs *flag.FlagSet, args []string) error {
+	if err := noArgs(fs, args); err != nil {
+		return err
+	}
+	c, done, err := connectHost(nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Reboot(context.Background()); err != nil {
+		return err
+	}
+	// Wait for the host to drop the connection, so we know
+	// the command was received
+	select {
+	case <-done:
+	case <-time.After(*timeoutArg):
+		return fmt.Errorf("host %s did not reboot in %v", c.Host.Host, *timeoutArg)
+	}
+	return nil
+}
+
+var wifiModeNames = map[uint8]string{
+	WifiModeAuto: "auto",
+	WifiModeSTA:  "sta",
+	WifiModeAP:   "ap",
+}
+
+func parseWifiMode(s string) (uint8, error) {
+	for k, v := range wifiModeNames {
+		if v == strings.ToLower(s) {
+			return k, nil
+		}
+	}
+	return 0, usageErrorf("invalid Wi-Fi mode %q, must be auto, sta or ap", s)
+}
+
+func printConfig(w io.Writer, cfg *HostConfig, showPassword bool) {
+	mode := wifiModeNames[cfg.WifiMode]
+	if mode == "" {
+		mode = fmt.Sprintf("unknown (%d)", cfg.WifiMode)
+	}
+	password := cfg.WifiPassword
+	if !showPassword && password != "" {
+		password = "(hidden, use -show-password to show it)"
+	}
+	fmt.Fprintf(w, "mode: %s\nssid: %s\npassword: %s\n", mode, cfg.WifiSSID, password)
+}
+
+// getConfig retrieves the configuration from the host, waiting
+// for the reply up to -timeout
+func getConfig(c *Client) (*HostConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutArg)
+	defer cancel()
+	cfg, err := c.GetConfig(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out waiting for configuration from %s", c.Host.Host)
+	}
+	return cfg, err
+}
+
+func runConfig(fs *flag.FlagSet, args []string) error {
+	showPassword := fs.Bool("show-password", false, "Show the Wi-Fi password (get)")
+	mode := fs.String("mode", "", "Wi-Fi mode: auto, sta or ap (set)")
+	ssid := fs.String("ssid", "", "Wi-Fi SSID (set)")
+	password := fs.String("password", "", "Wi-Fi password (set)")
+	args = parseArgs(fs, args)
+	if len(args) == 0 {
+		return usageErrorf("usage: config get|set")
+	}
+	switch args[0] {
+	case "get":
+		if len(args) > 1 {
+			return usageErrorf("config get takes no arguments")
+		}
+		if err := onlyFor(fs, "set", "mode", "ssid", "password"); err != nil {
+			return err
+		}
+		c, _, err := connectHost(nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		cfg, err := getConfig(c)
+		if err != nil {
+			return err
+		}
+		printConfig(os.Stdout, cfg, *showPassword)
+		return nil
+	case "set":
+		if len(args) > 1 {
+			return usageErrorf("config set takes no arguments")
+		}
+		if err := onlyFor(fs, "get", "show-password"); err != nil {
+			return err
+		}
+		changed := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			changed[f.Name] = true
+		})
+		if !changed["mode"] && !changed["ssid"] && !changed["password"] {
+			return usageErrorf("nothing to change, use -mode, -ssid or -password")
+		}
+		var wifiMode uint8
+		if changed["mode"] {
+			var err error
+			if wifiMode, err = parseWifiMode(*mode); err != nil {
+				return err
+			}
+		}
+		c, done, err := connectHost(nil)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		// Start from the current configuration, so only
+		// the given fields are changed
+		cfg, err := getConfig(c)
+		if err != nil {
+			return err
+		}
+		if changed["mode"] {
+			cfg.WifiMode = wifiMode
+		}
+		if changed["ssid"] {
+			cfg.WifiSSID = *ssid
+		}
+		if changed["password"] {
+			cfg.WifiPassword = *password
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeoutArg)
+		defer cancel()
+		if err := c.SetConfig(ctx, cfg); err != nil {
+			if err == context.DeadlineExceeded {
+				return fmt.Errorf("host %s did not confirm the new configuration", c.Host.Host)
+			}
+			return err
+		}
+		// SetConfig reboots the host to apply the configuration,
+		// wait until it drops the connection
+		select {
+		case <-done:
+		case <-time.After(*timeoutArg):
+			return fmt.Errorf("host %s did not apply the new configuration", c.Host.Host)
+		}
+		printConfig(os.Stdout, cfg, false)
+		return nil
+	}
+	return usageErrorf("unknown config command %q", args[0])
+}
+
+func runCoreDump(fs *flag.FlagSet, args []string) error {
+	erase := fs.Bool("erase", false, "Erase the coredump from the host after retrieving it (fetch)")
+	args = parseArgs(fs, args)
+	if len(args) > 0 && args[0] == "fetch" {
+		if len(args) > 1 {
+			return usageErrorf("coredump fetch takes no arguments")
+		}
+		return fetchCoreDump(*erase)
+	}
+	if err := onlyFor(fs, "fetch", "erase"); err != nil {
+		return err
+	}
+	dir := projectRelative(*coreDumpDirArg)
+	if dir == "" {
+		return errors.New("coredump archive is disabled")
+	}
+	return runCoreDumpCommand(newCoreDumpArchive(dir), args, os.Stdout)
+}
+
+// fetchCoreDump implements the coredump fetch command, which retrieves
+// the coredump from the host, archives it and prints it
+func fetchCoreDump(erase bool) error {
+	info, err := findProjectInfo(projectPath())
+	if err != nil {
+		return err
+	}
+	c, _, err := connectHost(info)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutArg)
+	defer cancel()
+	data, erased, err := c.FetchCoreDump(ctx, erase)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("timed out waiting for coredump from %s", c.Host.Host)
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		fmt.Fprintf(os.Stderr, "host %s has no coredump\n", c.Host.Host)
+		return nil
+	}
+	c.archiveCoreDump(data)
+	if len(data) < 4 {
+		return errors.New("coredump is too short")
+	}
+	cd, err := parseCoreDump(data[4:])
+	if err != nil {
+		return err
+	}
+	sym, err := c.symbolizer()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't load symbols from %s: %v\n", info.AppElf, err)
+	}
+	cd.Print(os.Stdout, sym)
+	if erased {
+		fmt.Fprintf(os.Stderr, "coredump erased from %s\n", c.Host.Host)
+	}
+	return nil
+}
+
+func runKey(fs *flag.FlagSet, args []string) error {
+	args = parseArgs(fs, args)
+	path := projectRelative(*signKeyArg)
+	if path == "" {
+		return errors.New("image signing is disabled")
+	}
+	return runKeyCommand(path, args, os.Stdout)
+}
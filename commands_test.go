@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+	"github.com/micro/mdns"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		positional []string
+		verbose    bool
+	}{
+		{nil, nil, false},
+		{[]string{"get"}, []string{"get"}, false},
+		{[]string{"-v", "get"}, []string{"get"}, true},
+		{[]string{"get", "-v"}, []string{"get"}, true},
+		{[]string{"show", "-v", "3"}, []string{"show", "3"}, true},
+		{[]string{"-name", "x", "show", "3"}, []string{"show", "3"}, false},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		verbose := fs.Bool("v", false, "")
+		name := fs.String("name", "", "")
+		positional := parseArgs(fs, tt.args)
+		if !reflect.DeepEqual(positional, tt.positional) || *verbose != tt.verbose {
+			t.Errorf("parseArgs(%q) = %q with -v = %v, want %q with -v = %v", tt.args, positional, *verbose, tt.positional, tt.verbose)
+		}
+		if containsString(tt.args, "-name") && *name != "x" {
+			t.Errorf("parseArgs(%q) set -name to %q, want x", tt.args, *name)
+		}
+	}
+}
+
+func TestRunConfigUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{nil, "usage: config get|set"},
+		{[]string{"bogus"}, `unknown config command "bogus"`},
+		{[]string{"get", "x"}, "config get takes no arguments"},
+		{[]string{"-ssid", "x", "get"}, "-ssid can only be used with config set"},
+		{[]string{"set", "-show-password"}, "-show-password can only be used with config get"},
+		{[]string{"set"}, "nothing to change"},
+		{[]string{"-mode", "x", "set"}, "invalid Wi-Fi mode"},
+	}
+	for _, tt := range tests {
+		err := runConfig(newCommandFlagSet(findCommand("config")), tt.args)
+		if _, ok := err.(usageError); !ok || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("config %q = %v, want a usage error containing %q", tt.args, err, tt.err)
+		}
+	}
+}
+
+func TestRunCoreDumpUsage(t *testing.T) {
+	for _, args := range [][]string{{"list", "-erase"}, {"-erase", "show", "1"}, {"fetch", "x"}} {
+		err := runCoreDump(newCommandFlagSet(findCommand("coredump")), args)
+		if _, ok := err.(usageError); !ok {
+			t.Errorf("coredump %q = %v, want a usage error", args, err)
+		}
+	}
+}
+
+func TestRunKeyFlagsAfterCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prev := *signKeyArg
+	defer func() { *signKeyArg = prev }()
+	path := filepath.Join(dir, "signing.pem")
+	if err := runKey(newCommandFlagSet(findCommand("key")), []string{"generate", "-sign-key", path}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("key not generated at -sign-key: %v", err)
+	}
+}
+
+func TestRunRebootTimeout(t *testing.T) {
+	// The scripted host doesn't drop the connection after
+	// receiving the reboot command
+	h := startScriptedHost(t)
+	defer h.close()
+	prevHost, prevAddr, prevTimeout := *hostArg, *addrArg, *timeoutArg
+	defer func() {
+		*hostArg, *addrArg, *timeoutArg = prevHost, prevAddr, prevTimeout
+	}()
+	*hostArg = ""
+	*addrArg = h.ln.Addr().String()
+	*timeoutArg = 500 * time.Millisecond
+	err := runReboot(newCommandFlagSet(findCommand("reboot")), nil)
+	if err == nil || !strings.Contains(err.Error(), "did not reboot") {
+		t.Errorf("reboot = %v, want an error", err)
+	}
+}
+
+// captureStdout returns what f writes to os.Stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	tmp, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	prev := os.Stdout
+	os.Stdout = tmp
+	defer func() {
+		os.Stdout = prev
+	}()
+	f()
+	data, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPrintHosts(t *testing.T) {
+	hosts := []*HostInfo{
+		{
+			Host: "a.local.",
+			IPv4: "192.168.1.10",
+			Port: 8888,
+			TXT: map[string]string{
+				protocol.TXTFirmwareVersion: "v1.0",
+				protocol.TXTChip:            "esp32",
+				protocol.TXTUptime:          "90",
+				"zone":                      "lab",
+				"flag":                      "",
+			},
+		},
+		{Host: "b.local.", IPv6: "fe80::1%en0", Port: 8888},
+	}
+	var buf bytes.Buffer
+	printHosts(&buf, hosts)
+	var lines [][]string
+	for _, v := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		lines = append(lines, strings.Fields(v))
+	}
+	want := [][]string{
+		{"Host", "IPv4", "IPv6", "Port", "Firmware", "Chip", "App", "Uptime", "Other"},
+		{"a.local.", "192.168.1.10", "-", "8888", "v1.0", "esp32", "-", "1m30s", "flag=", "zone=lab"},
+		{"b.local.", "-", "fe80::1%en0", "8888", "-", "-", "-", "-", "-"},
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("printHosts() printed:\n%s", buf.String())
+	}
+}
+
+func TestRunScan(t *testing.T) {
+	defer stubMDNS([]*mdns.ServiceEntry{
+		{Host: "b.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 11}},
+		{Host: "a.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 10}, InfoFields: []string{"version=v1.0", "chip=esp32"}},
+	}, nil)()
+	prevHost := *hostArg
+	defer func() {
+		*hostArg = prevHost
+	}()
+	*hostArg = ""
+	var err error
+	out := captureStdout(t, func() {
+		err = runScan(newCommandFlagSet(findCommand("scan")), []string{"-json", "-wait", "10ms"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hosts []*HostInfo
+	if err := json.Unmarshal([]byte(out), &hosts); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+	want := []*HostInfo{
+		{Host: "a.local.", IPv4: "192.168.1.10", Port: 8888, TXT: map[string]string{"version": "v1.0", "chip": "esp32"}},
+		{Host: "b.local.", IPv4: "192.168.1.11", Port: 8888},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("scan -json printed %s", out)
+	}
+	if strings.Contains(out, "ipv6") {
+		t.Errorf("scan -json printed empty fields: %s", out)
+	}
+
+	*hostArg = "missing"
+	out = captureStdout(t, func() {
+		err = runScan(newCommandFlagSet(findCommand("scan")), []string{"-wait", "10ms"})
+	})
+	if err == nil || out != "" {
+		t.Errorf("scan without hosts = %v, printed %q", err, out)
+	}
+}
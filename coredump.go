@@ -1,58 +1,84 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+
+	"github.com/fiam/idf_wmonitor/protocol"
 )
 
 // espcoredump.py dbg_corefile --core core.dump --core-format=raw ~/Source/esp/wifidev/build/blink.elf
 
-func (c *Client) runEspCoredump(filename string, op string) error {
+func (c *Client) runEspCoredump(data []byte, op string) error {
+	// Write the dump to a file, since espcoredump.py
+	// can't read it from stdin
+	tmpFile, err := ioutil.TempFile("", "core.*")
+	if err != nil {
+		return err
+	}
+	fileName := tmpFile.Name()
+	defer os.Remove(fileName)
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
 	info := c.ProjectInfo()
 	espcoredumpPy := filepath.Join(info.IDFPath, "components", "espcoredump", "espcoredump.py")
-	km := c.Stdin().(*keyboardMonitorReader).km
-	cmd := exec.Command("python", espcoredumpPy, op, "--core="+filename, "--core-format=raw", info.AppElf)
+	cmd := exec.Command("python", espcoredumpPy, op, "--core="+fileName, "--core-format=raw", info.AppElf)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	wait := make(chan struct{}, 1)
-	var err error
-	km.RunPaused(func() {
-		err = cmd.Run()
-		wait <- struct{}{}
-	})
-	<-wait
-	return err
+	if r, ok := c.Stdin().(*keyboardMonitorReader); ok {
+		// Give the terminal back to the user while gdb runs
+		r.km.RunPaused(func() {
+			err = cmd.Run()
+		})
+		return err
+	}
+	return cmd.Run()
 }
 
-func (c *Client) DisplayCoreDump(data []byte) (del bool, err error) {
-	// Write the dump to a file. Skip the initial magic number, since
-	// espcoredump.py expects the dump without it
-	tmpFile, err := ioutil.TempFile("", "core.*")
+// printCoreDump decodes the given raw coredump (without the leading
+// magic number) and prints it, symbolizing the addresses using the
+// app ELF when available.
+func (c *Client) printCoreDump(data []byte) error {
+	cd, err := parseCoreDump(data)
 	if err != nil {
-		return false, err
+		return err
 	}
-	fileName := tmpFile.Name()
-	defer os.Remove(fileName)
-	if _, err := tmpFile.Write(data[4:]); err != nil {
-		tmpFile.Close()
-		return false, err
+	sym, err := c.symbolizer()
+	if err != nil {
+		fmt.Fprintf(c.stderr, "can't load symbols from %s: %v\n", c.info.AppElf, err)
 	}
-	if err := tmpFile.Close(); err != nil {
-		return false, err
+	cd.Print(c.stdout, sym)
+	return nil
+}
+
+func (c *Client) DisplayCoreDump(data []byte) (del bool, err error) {
+	if len(data) < 4 {
+		return false, errors.New("coredump is too short")
 	}
+	// Skip the initial magic number, since neither our decoder
+	// nor espcoredump.py expect it
+	data = data[4:]
 	var ret error
 	c.PromptUser("Select what do to with this coredump [(V)iew/(g)db/(d)elete/(i)ignore]: ", func(s string) bool {
 		switch s {
 		case "v", "V", "":
-			if err := c.runEspCoredump(fileName, "info_corefile"); err != nil {
+			if err := c.printCoreDump(data); err != nil {
 				del = false
 				ret = err
 			}
 		case "g", "G":
-			if err := c.runEspCoredump(fileName, "dbg_corefile"); err != nil {
+			if err := c.runEspCoredump(data, "dbg_corefile"); err != nil {
 				del = false
 				ret = err
 			}
@@ -68,3 +94,33 @@ func (c *Client) DisplayCoreDump(data []byte) (del bool, err error) {
 	})
 	return del, ret
 }
+
+// FetchCoreDump retrieves the coredump stored in the host, without
+// prompting the user. It returns the coredump, including its leading
+// magic number, or nil if the host has none. If erase is true and the
+// host has a coredump, it's erased from the host. IgnoreCoreDumps
+// should be set before connecting, to avoid retrieving the coredump
+// twice.
+func (c *Client) FetchCoreDump(ctx context.Context, erase bool) (data []byte, erased bool, err error) {
+	if err := c.checkSupported(protocol.CmdCoredumpRead); err != nil {
+		return nil, false, err
+	}
+	reply, err := c.request(ctx, &protocol.CoredumpReadFrame{}, protocol.CmdCoredumpRead)
+	if err != nil {
+		return nil, false, err
+	}
+	if f := reply.(*protocol.CoredumpFrame); len(f.Data) > 0 {
+		data = f.Data
+	}
+	if data != nil && erase {
+		if _, err := c.request(ctx, &protocol.CoredumpEraseFrame{}, protocol.CmdCoredumpErase); err != nil {
+			return data, false, err
+		}
+		erased = true
+	}
+	// The host waits for us after sending a coredump
+	if err := c.send(&protocol.ContinueFrame{}); err != nil {
+		return data, erased, err
+	}
+	return data, erased, nil
+}
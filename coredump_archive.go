@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	coreDumpDataFile     = "core.dump"
+	coreDumpMetadataFile = "metadata.json"
+	coreDumpElfDir       = "elf"
+	coreDumpTimeFormat   = "20060102-150405"
+)
+
+// coreDumpMetadata is stored next to each archived coredump
+type coreDumpMetadata struct {
+	Host            string    `json:"host"`
+	Time            time.Time `json:"time"`
+	FirmwareVersion string    `json:"firmware_version,omitempty"`
+	ElfPath         string    `json:"elf_path"`
+	ElfSHA256       string    `json:"elf_sha256,omitempty"`
+	Size            int       `json:"size"`
+}
+
+// archivedCoreDump is a coredump stored in a coreDumpArchive
+type archivedCoreDump struct {
+	ID       string
+	Metadata coreDumpMetadata
+	archive  *coreDumpArchive
+}
+
+// coreDumpArchive stores every coredump retrieved from a host, together
+// with a copy of the app ELF that was current when it was retrieved, so
+// they can be analyzed later. Each coredump is stored in its own
+// directory, while ELF files are stored by their SHA-256 to avoid
+// duplicating them.
+type coreDumpArchive struct {
+	dir string
+	// stderr receives warnings about coredumps saved without
+	// their ELF, it might be nil
+	stderr io.Writer
+}
+
+func newCoreDumpArchive(dir string) *coreDumpArchive {
+	return &coreDumpArchive{dir: dir}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(dst string, src string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func (a *coreDumpArchive) elfPath(sha string) string {
+	return filepath.Join(a.dir, coreDumpElfDir, sha+".elf")
+}
+
+// mkdir creates the directory for a new coredump, returning its ID and
+// path. IDs have one second resolution, so a suffix is added to tell
+// apart the coredumps from the same host saved in the same second.
+func (a *coreDumpArchive) mkdir(md *coreDumpMetadata) (string, string, error) {
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return "", "", err
+	}
+	base := md.Time.Format(coreDumpTimeFormat) + "-" + strings.Replace(md.Host, string(filepath.Separator), "_", -1)
+	for n := 1; ; n++ {
+		id := base
+		if n > 1 {
+			id += "-" + strconv.Itoa(n)
+		}
+		dir := filepath.Join(a.dir, id)
+		err := os.Mkdir(dir, 0755)
+		if err == nil {
+			return id, dir, nil
+		}
+		if !os.IsExist(err) {
+			return "", "", err
+		}
+	}
+}
+
+// saveElf stores a copy of the ELF at path, returning its SHA-256
+func (a *coreDumpArchive) saveElf(path string) (string, error) {
+	sha, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Join(a.dir, coreDumpElfDir), 0755); err != nil {
+		return "", err
+	}
+	if dst := a.elfPath(sha); !fileExists(dst) {
+		if err := copyFile(dst, path); err != nil {
+			return "", err
+		}
+	}
+	return sha, nil
+}
+
+// Save stores a coredump as received from the host, including
+// its leading magic number. If the ELF can't be archived, the
+// coredump is saved without it.
+func (a *coreDumpArchive) Save(data []byte, md *coreDumpMetadata) (*archivedCoreDump, error) {
+	md.Size = len(data)
+	md.ElfSHA256 = ""
+	if md.ElfPath != "" {
+		sha, err := a.saveElf(md.ElfPath)
+		if err != nil {
+			if a.stderr != nil {
+				fmt.Fprintf(a.stderr, "can't archive the app ELF, saving the coredump without it: %v\n", err)
+			}
+		} else {
+			md.ElfSHA256 = sha
+		}
+	}
+	id, dir, err := a.mkdir(md)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, coreDumpDataFile), data, 0644); err != nil {
+		return nil, err
+	}
+	mdData, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, coreDumpMetadataFile), mdData, 0644); err != nil {
+		return nil, err
+	}
+	return &archivedCoreDump{ID: id, Metadata: *md, archive: a}, nil
+}
+
+// List returns all the coredumps in the archive, sorted from
+// oldest to newest.
+func (a *coreDumpArchive) List() ([]*archivedCoreDump, error) {
+	entries, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var dumps []*archivedCoreDump
+	for _, v := range entries {
+		if !v.IsDir() || v.Name() == coreDumpElfDir {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(a.dir, v.Name(), coreDumpMetadataFile))
+		if err != nil {
+			continue
+		}
+		dump := &archivedCoreDump{ID: v.Name(), archive: a}
+		if err := json.Unmarshal(data, &dump.Metadata); err != nil {
+			return nil, fmt.Errorf("error decoding metadata for %s: %v", v.Name(), err)
+		}
+		dumps = append(dumps, dump)
+	}
+	sort.Slice(dumps, func(i, j int) bool {
+		return dumps[i].Metadata.Time.Before(dumps[j].Metadata.Time)
+	})
+	return dumps, nil
+}
+
+// Find returns the coredump identified by the given string, which might
+// be either its index as shown by list, its ID or a prefix of its ID.
+func (a *coreDumpArchive) Find(id string) (*archivedCoreDump, error) {
+	dumps, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	if n, err := strconv.Atoi(id); err == nil && n >= 1 && n <= len(dumps) {
+		return dumps[n-1], nil
+	}
+	var found *archivedCoreDump
+	for _, v := range dumps {
+		if v.ID == id {
+			// IDs might be prefixes of others with a suffix
+			return v, nil
+		}
+	}
+	for _, v := range dumps {
+		if strings.HasPrefix(v.ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("%q matches more than one coredump", id)
+			}
+			found = v
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no coredump matching %q", id)
+	}
+	return found, nil
+}
+
+// Data returns the coredump, including the leading magic number
+func (d *archivedCoreDump) Data() ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(d.archive.dir, d.ID, coreDumpDataFile))
+}
+
+// ElfPath returns the path to the archived copy of the app ELF
+func (d *archivedCoreDump) ElfPath() string {
+	if d.Metadata.ElfSHA256 == "" {
+		return ""
+	}
+	return d.archive.elfPath(d.Metadata.ElfSHA256)
+}
+
+// archiveCoreDump saves a coredump retrieved from the host to the
+// project archive, if enabled.
+func (c *Client) archiveCoreDump(data []byte) {
+	if c.CoreDumpDir == "" {
+		return
+	}
+	md := &coreDumpMetadata{
+		Host:    c.hostName(),
+		Time:    time.Now(),
+		ElfPath: c.info.AppElf,
+	}
+	if info := c.DeviceInfo(); info != nil {
+		md.FirmwareVersion = info.FirmwareVersion
+	}
+	archive := newCoreDumpArchive(c.CoreDumpDir)
+	archive.stderr = c.stderr
+	dump, err := archive.Save(data, md)
+	if err != nil {
+		fmt.Fprintf(c.stderr, "error archiving coredump: %v\n", err)
+		return
+	}
+	fmt.Fprintf(c.stdout, "coredump archived as %s\n", dump.ID)
+}
+
+// runCoreDumpCommand implements the coredump list and show subcommands
+func runCoreDumpCommand(archive *coreDumpArchive, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return usageErrorf("usage: coredump list|show <id>|fetch")
+	}
+	switch args[0] {
+	case "list":
+		dumps, err := archive.List()
+		if err != nil {
+			return err
+		}
+		if len(dumps) == 0 {
+			fmt.Fprintf(w, "no coredumps in %s\n", archive.dir)
+			return nil
+		}
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "#\tID\tHost\tTime\tFirmware\tELF\n")
+		for ii, v := range dumps {
+			elf := v.Metadata.ElfSHA256
+			if len(elf) > 12 {
+				elf = elf[:12]
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", ii+1, v.ID, v.Metadata.Host,
+				v.Metadata.Time.Format(time.RFC3339), v.Metadata.FirmwareVersion, elf)
+		}
+		return tw.Flush()
+	case "show":
+		if len(args) != 2 {
+			return usageErrorf("usage: coredump show <id>")
+		}
+		dump, err := archive.Find(args[1])
+		if err != nil {
+			return err
+		}
+		data, err := dump.Data()
+		if err != nil {
+			return err
+		}
+		if len(data) < 4 {
+			return errors.New("coredump is too short")
+		}
+		md := dump.Metadata
+		fmt.Fprintf(w, "Coredump %s\nHost: %s\nTime: %s\nFirmware: %s\nELF: %s (sha256 %s)\n\n",
+			dump.ID, md.Host, md.Time.Format(time.RFC3339), md.FirmwareVersion, md.ElfPath, md.ElfSHA256)
+		cd, err := parseCoreDump(data[4:])
+		if err != nil {
+			return err
+		}
+		var sym *Symbolizer
+		if elfPath := dump.ElfPath(); elfPath != "" {
+			if sym, err = NewSymbolizer(elfPath); err != nil {
+				fmt.Fprintf(w, "can't load symbols from %s: %v\n", elfPath, err)
+			}
+		}
+		cd.Print(w, sym)
+		return nil
+	}
+	return usageErrorf("unknown coredump command %q", args[0])
+}
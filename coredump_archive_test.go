@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoreDumpArchiveSameSecond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := newCoreDumpArchive(dir)
+	now := time.Now()
+	var saved []*archivedCoreDump
+	for ii := 0; ii < 3; ii++ {
+		md := &coreDumpMetadata{Host: "dev", Time: now.Add(time.Duration(ii) * time.Millisecond)}
+		dump, err := archive.Save([]byte{byte(ii)}, md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, dump)
+	}
+	dumps, err := archive.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != len(saved) {
+		t.Fatalf("archive has %d coredumps, want %d", len(dumps), len(saved))
+	}
+	for ii, v := range saved {
+		found, err := archive.Find(v.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := found.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, []byte{byte(ii)}) {
+			t.Errorf("coredump %s has data %v, want %v", v.ID, data, []byte{byte(ii)})
+		}
+	}
+}
+
+func TestCoreDumpArchiveElf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coredumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	elfPath := filepath.Join(dir, "app.elf")
+	if err := ioutil.WriteFile(elfPath, []byte("elf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	archive := newCoreDumpArchive(filepath.Join(dir, "archive"))
+	archive.stderr = &stderr
+
+	dump, err := archive.Save([]byte{1}, &coreDumpMetadata{Host: "dev", Time: time.Now(), ElfPath: elfPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(dump.ElfPath()); err != nil || string(data) != "elf" {
+		t.Errorf("archived ELF = %q, %v, want \"elf\"", data, err)
+	}
+
+	// The coredump must be saved even if the ELF is gone
+	missing := filepath.Join(dir, "missing.elf")
+	dump, err = archive.Save([]byte{2}, &coreDumpMetadata{Host: "dev", Time: time.Now(), ElfPath: missing})
+	if err != nil {
+		t.Fatalf("Save() with a missing ELF = %v", err)
+	}
+	if dump.Metadata.ElfSHA256 != "" || dump.ElfPath() != "" {
+		t.Errorf("coredump without ELF has ELF %q", dump.ElfPath())
+	}
+	if data, err := dump.Data(); err != nil || !bytes.Equal(data, []byte{2}) {
+		t.Errorf("Data() = %v, %v, want [2]", data, err)
+	}
+	if !strings.Contains(stderr.String(), missing) {
+		t.Errorf("no warning about the missing ELF, stderr = %q", stderr.String())
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Layout of the raw coredumps written by ESP-IDF to flash, after
+// the leading magic number. See espcoredump.py for reference.
+const (
+	coreDumpHeaderSize     = 12 // tot_len, task_num, tcb_sz
+	coreDumpTaskHeaderSize = 12 // tcb_addr, stack_top, stack_end
+	// Offset and size of pcTaskName inside the FreeRTOS TCB
+	coreDumpTCBNameOffset = 0x34
+	coreDumpTCBNameSize   = 16
+	// Maximum number of frames to walk while building a backtrace
+	coreDumpMaxFrames = 64
+)
+
+// Indexes into the Xtensa exception frame saved on the stack
+const (
+	xtStkExit     = 0
+	xtStkPC       = 1
+	xtStkPS       = 2
+	xtStkARStart  = 3
+	xtStkARNum    = 16
+	xtStkSAR      = 19
+	xtStkExcCause = 20
+	xtStkExcVAddr = 21
+	xtStkFrameLen = 25
+)
+
+// Indexes into the Xtensa solicited frame saved on the stack
+const (
+	xtSolPC      = 1
+	xtSolPS      = 2
+	xtSolARStart = 4
+	xtSolARNum   = 4
+)
+
+var xtensaExceptionCauses = map[uint32]string{
+	0:  "IllegalInstruction",
+	1:  "Syscall",
+	2:  "InstructionFetchError",
+	3:  "LoadStoreError",
+	4:  "Level1Interrupt",
+	5:  "Alloca",
+	6:  "IntegerDivideByZero",
+	8:  "Privileged",
+	9:  "LoadStoreAlignment",
+	12: "InstrPIFDataError",
+	13: "LoadStorePIFDataError",
+	14: "InstrPIFAddrError",
+	15: "LoadStorePIFAddrError",
+	16: "InstTLBMiss",
+	17: "InstTLBMultiHit",
+	18: "InstFetchPrivilege",
+	20: "InstFetchProhibited",
+	24: "LoadStoreTLBMiss",
+	25: "LoadStoreTLBMultiHit",
+	26: "LoadStorePrivilege",
+	28: "LoadProhibited",
+	29: "StoreProhibited",
+}
+
+type memoryRegion struct {
+	addr uint32
+	data []byte
+}
+
+type coreDumpTask struct {
+	TCBAddr  uint32
+	StackTop uint32
+	StackEnd uint32
+	Name     string
+	// Registers restored from the frame at the top of the stack
+	PC uint32
+	PS uint32
+	AR [16]uint32
+	// Exception information, only valid if IsException is true
+	IsException bool
+	SAR         uint32
+	ExcCause    uint32
+	ExcVAddr    uint32
+}
+
+type coreDump struct {
+	Tasks  []*coreDumpTask
+	memory []memoryRegion
+}
+
+func (cd *coreDump) readUint32(addr uint32) (uint32, bool) {
+	for _, v := range cd.memory {
+		if addr >= v.addr && uint64(addr)+4 <= uint64(v.addr)+uint64(len(v.data)) {
+			off := addr - v.addr
+			return binary.LittleEndian.Uint32(v.data[off:]), true
+		}
+	}
+	return 0, false
+}
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// parseCoreDump parses a raw coredump, without the leading magic number
+func parseCoreDump(data []byte) (*coreDump, error) {
+	if len(data) < coreDumpHeaderSize {
+		return nil, errors.New("coredump is too short")
+	}
+	taskNum := binary.LittleEndian.Uint32(data[4:])
+	tcbSize := binary.LittleEndian.Uint32(data[8:])
+	// Do all the bounds checks using ints, since sizes read from a
+	// corrupt coredump might overflow when added as uint32
+	size := len(data)
+	if uint64(tcbSize) > uint64(size) {
+		return nil, fmt.Errorf("invalid TCB size %d", tcbSize)
+	}
+	tcbLen := int(tcbSize)
+	tcbLenAligned := int(align4(tcbSize))
+	off := coreDumpHeaderSize
+	cd := &coreDump{}
+	for ii := uint32(0); ii < taskNum; ii++ {
+		if off+coreDumpTaskHeaderSize > size {
+			return nil, fmt.Errorf("truncated header for task %d", ii)
+		}
+		task := &coreDumpTask{
+			TCBAddr:  binary.LittleEndian.Uint32(data[off:]),
+			StackTop: binary.LittleEndian.Uint32(data[off+4:]),
+			StackEnd: binary.LittleEndian.Uint32(data[off+8:]),
+		}
+		off += coreDumpTaskHeaderSize
+		if off+tcbLenAligned > size {
+			return nil, fmt.Errorf("truncated TCB for task %d", ii)
+		}
+		tcb := data[off : off+tcbLen]
+		off += tcbLenAligned
+		if task.StackEnd <= task.StackTop {
+			// ESP32 stacks always grow down
+			return nil, fmt.Errorf("task %d has invalid stack bounds 0x%08x-0x%08x", ii, task.StackTop, task.StackEnd)
+		}
+		stackSize := task.StackEnd - task.StackTop
+		if uint64(stackSize) > uint64(size) {
+			return nil, fmt.Errorf("task %d has invalid stack size %d", ii, stackSize)
+		}
+		stackLen := int(align4(stackSize))
+		if off+stackLen > size {
+			return nil, fmt.Errorf("truncated stack for task %d", ii)
+		}
+		stack := data[off : off+stackLen]
+		off += stackLen
+
+		if len(tcb) >= coreDumpTCBNameOffset+coreDumpTCBNameSize {
+			name := tcb[coreDumpTCBNameOffset : coreDumpTCBNameOffset+coreDumpTCBNameSize]
+			if idx := bytes.IndexByte(name, 0); idx >= 0 {
+				name = name[:idx]
+			}
+			task.Name = string(name)
+		}
+		if err := task.restoreRegisters(stack); err != nil {
+			return nil, fmt.Errorf("task %d: %v", ii, err)
+		}
+		cd.Tasks = append(cd.Tasks, task)
+		cd.memory = append(cd.memory,
+			memoryRegion{addr: task.TCBAddr, data: tcb},
+			memoryRegion{addr: task.StackTop, data: stack})
+	}
+	return cd, nil
+}
+
+func (t *coreDumpTask) restoreRegisters(stack []byte) error {
+	if len(stack) < xtStkFrameLen*4 {
+		return errors.New("stack too short to contain a frame")
+	}
+	frame := make([]uint32, xtStkFrameLen)
+	for ii := range frame {
+		frame[ii] = binary.LittleEndian.Uint32(stack[ii*4:])
+	}
+	if frame[xtStkExit] == 0 {
+		// Solicited frame, the task yielded
+		t.PC = frame[xtSolPC]
+		t.PS = frame[xtSolPS]
+		copy(t.AR[:], frame[xtSolARStart:xtSolARStart+xtSolARNum])
+		return nil
+	}
+	t.IsException = true
+	t.PC = frame[xtStkPC]
+	t.PS = frame[xtStkPS]
+	copy(t.AR[:], frame[xtStkARStart:xtStkARStart+xtStkARNum])
+	t.SAR = frame[xtStkSAR]
+	t.ExcCause = frame[xtStkExcCause]
+	t.ExcVAddr = frame[xtStkExcVAddr]
+	return nil
+}
+
+// xtensaPC converts a return address stored with the windowed ABI, which
+// uses the top 2 bits to store the window increment, into a PC
+func xtensaPC(addr uint32) uint32 {
+	if addr&0x80000000 != 0 {
+		return (addr & 0x3fffffff) | 0x40000000
+	}
+	return addr
+}
+
+// Backtrace walks the stack of the given task, using the same algorithm
+// as esp_backtrace_print(). The first address is the current PC.
+func (cd *coreDump) Backtrace(t *coreDumpTask) []uint32 {
+	pc := t.PC
+	nextPC := t.AR[0]
+	sp := t.AR[1]
+	frames := []uint32{xtensaPC(pc)}
+	for len(frames) < coreDumpMaxFrames && nextPC != 0 {
+		// The base save area for the caller is in the 4 words below SP
+		a0, ok1 := cd.readUint32(sp - 16)
+		a1, ok2 := cd.readUint32(sp - 12)
+		if !ok1 || !ok2 {
+			break
+		}
+		pc = nextPC
+		nextPC = a0
+		sp = a1
+		frames = append(frames, xtensaPC(pc))
+	}
+	return frames
+}
+
+// Print writes a human readable report of the coredump to w. The first
+// task in the coredump is the one which was running when the
+// crash occurred.
+func (cd *coreDump) Print(w io.Writer, sym *Symbolizer) {
+	if len(cd.Tasks) == 0 {
+		fmt.Fprintf(w, "coredump contains no tasks\n")
+		return
+	}
+	crashed := cd.Tasks[0]
+	fmt.Fprintf(w, "==================== CRASHED TASK %q ====================\n", crashed.Name)
+	if crashed.IsException {
+		cause := xtensaExceptionCauses[crashed.ExcCause]
+		if cause == "" {
+			cause = "Unknown"
+		}
+		fmt.Fprintf(w, "EXCCAUSE 0x%08x (%s) EXCVADDR 0x%08x\n", crashed.ExcCause, cause, crashed.ExcVAddr)
+	}
+	fmt.Fprintf(w, "PC       0x%08x  %s\n", crashed.PC, sym.Describe(uint64(xtensaPC(crashed.PC))))
+	fmt.Fprintf(w, "PS       0x%08x\n", crashed.PS)
+	if crashed.IsException {
+		fmt.Fprintf(w, "SAR      0x%08x\n", crashed.SAR)
+	}
+	for ii := 0; ii < len(crashed.AR); ii += 4 {
+		fmt.Fprintf(w, "A%-2d 0x%08x  A%-2d 0x%08x  A%-2d 0x%08x  A%-2d 0x%08x\n",
+			ii, crashed.AR[ii], ii+1, crashed.AR[ii+1], ii+2, crashed.AR[ii+2], ii+3, crashed.AR[ii+3])
+	}
+	fmt.Fprintf(w, "\n==================== BACKTRACE ====================\n")
+	cd.printBacktrace(w, crashed, sym)
+	fmt.Fprintf(w, "\n==================== TASKS ====================\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, " \t#\tTCB\tName\tPC\n")
+	for ii, v := range cd.Tasks {
+		current := " "
+		if v == crashed {
+			current = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t0x%08x\t%s\t0x%08x %s\n", current, ii+1, v.TCBAddr, v.Name, v.PC, sym.Describe(uint64(xtensaPC(v.PC))))
+	}
+	tw.Flush()
+	for _, v := range cd.Tasks[1:] {
+		fmt.Fprintf(w, "\n==================== TASK %q ====================\n", v.Name)
+		cd.printBacktrace(w, v, sym)
+	}
+}
+
+func (cd *coreDump) printBacktrace(w io.Writer, t *coreDumpTask, sym *Symbolizer) {
+	for ii, v := range cd.Backtrace(t) {
+		fmt.Fprintf(w, "#%-2d 0x%08x in %s\n", ii, v, sym.Describe(uint64(v)))
+	}
+}
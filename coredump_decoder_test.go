@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testCoreDumpTask struct {
+	tcbAddr  uint32
+	stackTop uint32
+	name     string
+	// stack contains the words in the stack, starting at stackTop
+	stack []uint32
+}
+
+// buildCoreDump returns a raw coredump without the leading magic
+// number, laid out like the ones written by ESP-IDF
+func buildCoreDump(tcbSize uint32, tasks []testCoreDumpTask) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&buf, le, uint32(0))
+	binary.Write(&buf, le, uint32(len(tasks)))
+	binary.Write(&buf, le, tcbSize)
+	for _, v := range tasks {
+		binary.Write(&buf, le, v.tcbAddr)
+		binary.Write(&buf, le, v.stackTop)
+		binary.Write(&buf, le, v.stackTop+uint32(len(v.stack)*4))
+		tcb := make([]byte, align4(tcbSize))
+		copy(tcb[coreDumpTCBNameOffset:coreDumpTCBNameOffset+coreDumpTCBNameSize-1], v.name)
+		buf.Write(tcb)
+		binary.Write(&buf, le, v.stack)
+	}
+	data := buf.Bytes()
+	le.PutUint32(data, uint32(len(data)))
+	return data
+}
+
+const (
+	testCrashedStack = 0x3ffb0000
+	testIdleStack    = 0x3ffb1000
+)
+
+// testCoreDumpTasks contains a task which crashed with a LoadProhibited
+// exception with 3 frames in its backtrace, and an idle task which yielded
+func testCoreDumpTasks() []testCoreDumpTask {
+	crashed := make([]uint32, 0x80)
+	crashed[xtStkExit] = 0x40081234
+	crashed[xtStkPC] = 0x400d1000
+	crashed[xtStkPS] = 0x00060030
+	// A0 is the return address and A1 the stack pointer
+	crashed[xtStkARStart] = 0x800d2000
+	crashed[xtStkARStart+1] = testCrashedStack + 0x100
+	crashed[xtStkSAR] = 0x1f
+	crashed[xtStkExcCause] = 28
+	crashed[xtStkExcVAddr] = 0x00000004
+	// Base save area for the caller of the second frame, which
+	// returns to the third one
+	crashed[(0x100-16)/4] = 0x800d3000
+	crashed[(0x100-12)/4] = testCrashedStack + 0x180
+	// The third frame is the last one
+	crashed[(0x180-16)/4] = 0
+	crashed[(0x180-12)/4] = testCrashedStack + 0x200
+
+	idle := make([]uint32, 0x40)
+	idle[xtSolPC] = 0x400d4000
+	idle[xtSolPS] = 0x00060020
+	idle[xtSolARStart+1] = testIdleStack + 0x100
+
+	return []testCoreDumpTask{
+		{tcbAddr: 0x3ffb8000, stackTop: testCrashedStack, name: "main", stack: crashed},
+		{tcbAddr: 0x3ffb9000, stackTop: testIdleStack, name: "IDLE0", stack: idle},
+	}
+}
+
+func TestParseCoreDump(t *testing.T) {
+	// Use an unaligned TCB size, like the real one
+	data := buildCoreDump(0x15c-1, testCoreDumpTasks())
+	cd, err := parseCoreDump(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cd.Tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(cd.Tasks))
+	}
+	crashed, idle := cd.Tasks[0], cd.Tasks[1]
+	if crashed.Name != "main" || !crashed.IsException || crashed.ExcCause != 28 ||
+		crashed.ExcVAddr != 4 || crashed.PC != 0x400d1000 || crashed.SAR != 0x1f {
+		t.Errorf("crashed task = %+v", crashed)
+	}
+	if want := []uint32{0x400d1000, 0x400d2000, 0x400d3000}; !reflect.DeepEqual(cd.Backtrace(crashed), want) {
+		t.Errorf("crashed task backtrace = %x, want %x", cd.Backtrace(crashed), want)
+	}
+	if idle.Name != "IDLE0" || idle.IsException || idle.PC != 0x400d4000 || idle.AR[1] != testIdleStack+0x100 {
+		t.Errorf("idle task = %+v", idle)
+	}
+	if want := []uint32{0x400d4000}; !reflect.DeepEqual(cd.Backtrace(idle), want) {
+		t.Errorf("idle task backtrace = %x, want %x", cd.Backtrace(idle), want)
+	}
+
+	var out bytes.Buffer
+	cd.Print(&out, nil)
+	for _, v := range []string{`CRASHED TASK "main"`, "LoadProhibited", "#2  0x400d3000", `TASK "IDLE0"`} {
+		if !strings.Contains(out.String(), v) {
+			t.Errorf("output doesn't contain %q:\n%s", v, out.String())
+		}
+	}
+}
+
+func TestParseCoreDumpInvalid(t *testing.T) {
+	valid := buildCoreDump(0x15c, testCoreDumpTasks())
+	withUint32 := func(off int, v uint32) []byte {
+		data := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint32(data[off:], v)
+		return data
+	}
+	const (
+		firstTask  = coreDumpHeaderSize
+		secondTask = firstTask + coreDumpTaskHeaderSize + 0x15c + 0x80*4
+	)
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "too short"},
+		{"short header", valid[:8], "too short"},
+		{"truncated task header", valid[:secondTask+4], "truncated header for task 1"},
+		{"truncated TCB", valid[:firstTask+coreDumpTaskHeaderSize+0x150], "truncated TCB for task 0"},
+		{"truncated stack", valid[:firstTask+coreDumpTaskHeaderSize+0x15c+0x100], "truncated stack for task 0"},
+		{"truncated second task", valid[:len(valid)-4], "truncated stack for task 1"},
+		{"too many tasks", withUint32(4, 3), "truncated header for task 2"},
+		{"huge TCB", withUint32(8, 0xffffffff), "invalid TCB size"},
+		{"TCB larger than the coredump", withUint32(8, uint32(len(valid))+1), "invalid TCB size"},
+		{"huge stack", withUint32(firstTask+8, 0xffffffff), "invalid stack size"},
+		{"stack larger than the coredump", withUint32(firstTask+4, 0), "invalid stack size"},
+		{"invalid stack bounds", withUint32(firstTask+8, testCrashedStack), "invalid stack bounds"},
+		{"short stack", withUint32(firstTask+8, testCrashedStack+8), "stack too short"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cd, err := parseCoreDump(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseCoreDump() = %v, %v, want error containing %q", cd, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseCoreDumpGarbage(t *testing.T) {
+	// Random data must never panic. Use a valid header for half of
+	// the inputs, so they get past the first checks.
+	valid := buildCoreDump(0x15c, testCoreDumpTasks())
+	rnd := rand.New(rand.NewSource(1))
+	for ii := 0; ii < 5000; ii++ {
+		data := make([]byte, rnd.Intn(len(valid)+100))
+		rnd.Read(data)
+		if ii%2 == 0 {
+			copy(data, valid[:coreDumpHeaderSize+coreDumpTaskHeaderSize])
+		}
+		if cd, err := parseCoreDump(data); err == nil {
+			// Walking the backtraces must not panic either
+			for _, v := range cd.Tasks {
+				cd.Backtrace(v)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Event is implemented by the events delivered to the handlers
+// added with Client.Subscribe. Use a type switch to tell them apart.
+type Event interface {
+	// EventHost returns the name of the host the event comes from
+	EventHost() string
+}
+
+// LogLine is a line printed by the host, without the line terminator
+type LogLine struct {
+	Host   string
+	Stderr bool
+	Text   string
+}
+
+// OTAProgress is reported when the host commits more of the image
+type OTAProgress struct {
+	Host   string
+	Offset int
+	Size   int
+	// Throughput is the upload rate in bytes per second
+	Throughput float64
+}
+
+// OTAResult is reported when Flash finishes, either because the host
+// reported the result or because the transfer was abandoned. Err is
+// nil if the update succeeded.
+type OTAResult struct {
+	Host string
+	Size int
+	Err  error
+}
+
+// CoredumpAvailable is reported when the host sends a coredump. Data
+// includes the leading magic number.
+type CoredumpAvailable struct {
+	Host string
+	Data []byte
+}
+
+// ConfigReceived is reported when the host sends its configuration,
+// either in reply to GetConfig or after SetConfig
+type ConfigReceived struct {
+	Host   string
+	Config *HostConfig
+}
+
+// Disconnected is reported when Run returns. Err is the error returned
+// by Run, nil if the connection was closed with Close.
+type Disconnected struct {
+	Host string
+	Err  error
+}
+
+func (e *LogLine) EventHost() string           { return e.Host }
+func (e *OTAProgress) EventHost() string       { return e.Host }
+func (e *OTAResult) EventHost() string         { return e.Host }
+func (e *CoredumpAvailable) EventHost() string { return e.Host }
+func (e *ConfigReceived) EventHost() string    { return e.Host }
+func (e *Disconnected) EventHost() string      { return e.Host }
+
+// EventHandler receives the events from a Client. It's called from the
+// goroutine which generated the event, usually the one running Run, so
+// it must not block.
+type EventHandler func(Event)
+
+// eventHandlers holds the handlers subscribed to a Client
+type eventHandlers struct {
+	mu       sync.Mutex
+	nextID   int
+	handlers map[int]EventHandler
+}
+
+func (h *eventHandlers) add(handler EventHandler) func() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.handlers == nil {
+		h.handlers = make(map[int]EventHandler)
+	}
+	id := h.nextID
+	h.nextID++
+	h.handlers[id] = handler
+	return func() {
+		h.mu.Lock()
+		delete(h.handlers, id)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHandlers) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.handlers) == 0
+}
+
+func (h *eventHandlers) emit(ev Event) {
+	h.mu.Lock()
+	handlers := make([]EventHandler, 0, len(h.handlers))
+	for _, v := range h.handlers {
+		handlers = append(handlers, v)
+	}
+	h.mu.Unlock()
+	for _, v := range handlers {
+		v(ev)
+	}
+}
+
+// Subscribe adds a handler for the events from the client, returning
+// a function which removes it. The text output is still written to
+// the writers passed to NewClient.
+func (c *Client) Subscribe(handler EventHandler) (unsubscribe func()) {
+	return c.events.add(handler)
+}
+
+func (c *Client) emit(ev Event) {
+	c.events.emit(ev)
+}
+
+// emitOutput splits the output from the host into lines and emits
+// a LogLine for each complete one. It's only called from Run.
+func (c *Client) emitOutput(stderr bool, data []byte) {
+	if c.events.empty() {
+		return
+	}
+	buf := &c.logBufs[0]
+	if stderr {
+		buf = &c.logBufs[1]
+	}
+	*buf = append(*buf, data...)
+	for {
+		nl := bytes.IndexByte(*buf, '\n')
+		if nl < 0 {
+			break
+		}
+		line := bytes.TrimSuffix((*buf)[:nl], []byte{'\r'})
+		c.emit(&LogLine{Host: c.hostName(), Stderr: stderr, Text: string(line)})
+		*buf = (*buf)[nl+1:]
+	}
+}
+
+// flushOutput emits the incomplete lines left in the buffers,
+// since the host won't finish them after disconnecting
+func (c *Client) flushOutput() {
+	for ii := range c.logBufs {
+		if buf := c.logBufs[ii]; len(buf) > 0 {
+			c.emit(&LogLine{Host: c.hostName(), Stderr: ii == 1, Text: string(buf)})
+		}
+		c.logBufs[ii] = nil
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// eventRecorder is an EventHandler which stores the events it receives
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) handle(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *eventRecorder) all() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// logLines returns the text of the LogLine events
+func (r *eventRecorder) logLines(stderr bool) []string {
+	var lines []string
+	for _, v := range r.all() {
+		if ev, ok := v.(*LogLine); ok && ev.Stderr == stderr {
+			lines = append(lines, ev.Text)
+		}
+	}
+	return lines
+}
+
+// waitFor waits until the recorder receives an event for which
+// match returns true, returning it
+func (r *eventRecorder) waitFor(t *testing.T, match func(Event) bool) Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, v := range r.all() {
+			if match(v) {
+				return v
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for event, got %v", r.all())
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), &lockedBuffer{}, &lockedBuffer{})
+	var first, second eventRecorder
+	unsubscribe := c.Subscribe(first.handle)
+	c.Subscribe(second.handle)
+	c.emit(&Disconnected{})
+	unsubscribe()
+	unsubscribe()
+	c.emit(&Disconnected{})
+	if n := len(first.all()); n != 1 {
+		t.Errorf("unsubscribed handler received %d events, want 1", n)
+	}
+	if n := len(second.all()); n != 2 {
+		t.Errorf("subscribed handler received %d events, want 2", n)
+	}
+}
+
+func TestEmitOutput(t *testing.T) {
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), &lockedBuffer{}, &lockedBuffer{})
+	// Output received without subscribers is not buffered
+	c.emitOutput(false, []byte("ignored"))
+	var rec eventRecorder
+	c.Subscribe(rec.handle)
+	for _, v := range []struct {
+		stderr bool
+		data   string
+	}{
+		{false, "hel"},
+		{true, "err"},
+		{false, "lo\r"},
+		{false, "\nwor"},
+		{true, "or\r\n"},
+		{false, "ld\n\nlast"},
+	} {
+		c.emitOutput(v.stderr, []byte(v.data))
+	}
+	if got, want := rec.logLines(false), []string{"hello", "world", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stdout lines = %q, want %q", got, want)
+	}
+	if got, want := rec.logLines(true), []string{"error"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stderr lines = %q, want %q", got, want)
+	}
+	c.flushOutput()
+	if got, want := rec.logLines(false), []string{"hello", "world", "", "last"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stdout lines after flushing = %q, want %q", got, want)
+	}
+	c.flushOutput()
+	if n := len(rec.all()); n != 5 {
+		t.Errorf("got %d events after flushing twice, want 5", n)
+	}
+}
+
+func TestEventsFromDevice(t *testing.T) {
+	d := fakedevice.New("dev")
+	d.SetConfig(&protocol.Config{Version: protocol.ConfigVersion, WifiSSID: "ssid"})
+	coredump := append([]byte{0xE5, 0xE5, 0xE5, 0xE5}, make([]byte, 100)...)
+	d.SetCoredump(coredump)
+	startDevice(t, d)
+	defer d.Close()
+	var rec eventRecorder
+	c := connectClient(t, d, func(c *Client) {
+		c.IgnoreCoreDumps = true
+		c.Subscribe(rec.handle)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.GetConfig(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ev := rec.waitFor(t, func(ev Event) bool { _, ok := ev.(*ConfigReceived); return ok }).(*ConfigReceived)
+	if ev.Host != "dev" || ev.Config.WifiSSID != "ssid" {
+		t.Errorf("ConfigReceived = %+v", ev)
+	}
+
+	if _, _, err := c.FetchCoreDump(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	cd := rec.waitFor(t, func(ev Event) bool { _, ok := ev.(*CoredumpAvailable); return ok }).(*CoredumpAvailable)
+	if !bytes.Equal(cd.Data, coredump) {
+		t.Errorf("CoredumpAvailable has %d bytes, want %d", len(cd.Data), len(coredump))
+	}
+
+	image := testImage(100000)
+	if err := c.Flash(ctx, bytes.NewReader(image)); err != nil {
+		t.Fatal(err)
+	}
+	res := rec.waitFor(t, func(ev Event) bool { _, ok := ev.(*OTAResult); return ok }).(*OTAResult)
+	if res.Host != "dev" || res.Size != len(image) || res.Err != nil {
+		t.Errorf("OTAResult = %+v", res)
+	}
+	prev := -1
+	for _, v := range rec.all() {
+		if p, ok := v.(*OTAProgress); ok {
+			if p.Offset < prev || p.Size != len(image) {
+				t.Errorf("OTAProgress = %+v after offset %d", p, prev)
+			}
+			prev = p.Offset
+		}
+	}
+	if prev != len(image) {
+		t.Errorf("last OTAProgress offset = %d, want %d", prev, len(image))
+	}
+
+	// Incomplete lines are flushed on disconnection,
+	// before reporting it
+	d.Printf("partial")
+	for !strings.Contains(c.stdout.String(), "partial") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.Close()
+	if err := c.wait(t); err == nil {
+		t.Error("Run() = nil after the device closed the connection")
+	}
+	events := rec.all()
+	if len(events) < 2 {
+		t.Fatalf("got %d events", len(events))
+	}
+	if ev, ok := events[len(events)-2].(*LogLine); !ok || ev.Text != "partial" {
+		t.Errorf("second to last event = %+v, want the partial line", events[len(events)-2])
+	}
+	if ev, ok := events[len(events)-1].(*Disconnected); !ok || ev.Err == nil || ev.Host != "dev" {
+		t.Errorf("last event = %+v, want Disconnected with an error", events[len(events)-1])
+	}
+}
+
+func TestDisconnectedOnClose(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	var rec eventRecorder
+	c := connectClient(t, d, func(c *Client) { c.Subscribe(rec.handle) })
+	c.close(t)
+	events := rec.all()
+	if len(events) == 0 {
+		t.Fatal("no events received")
+	}
+	if ev, ok := events[len(events)-1].(*Disconnected); !ok || ev.Err != nil {
+		t.Errorf("last event = %+v, want Disconnected without an error", events[len(events)-1])
+	}
+}
@@ -0,0 +1,539 @@
+// Package fakedevice implements a simulated device which speaks the device
+// side of the monitor protocol over TCP. It can be used to exercise the
+// client without real hardware.
+package fakedevice
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+	"github.com/micro/mdns"
+)
+
+const (
+	// otaProgressStep is the number of bytes between OTA progress messages
+	otaProgressStep = 16 * 1024
+)
+
+// Device is a simulated device. Its exported fields must be set before
+// calling Listen.
+type Device struct {
+	// Name is the host name advertised over mDNS
+	Name string
+	// FailOTA makes all OTA updates fail
+	FailOTA bool
+	// FailOTACount makes the first FailOTACount OTA updates fail,
+	// to simulate transient failures
+	FailOTACount int
+	// CorruptOTA flips a bit in every received OTA image, to
+	// simulate corruption during the transfer
+	CorruptOTA bool
+	// FirmwareVersion is reported to clients during the handshake
+	FirmwareVersion string
+	// Legacy makes the device behave like firmware which predates
+	// the handshake, silently ignoring CmdHello and the other
+	// commands it doesn't support.
+	Legacy bool
+	// Commands contains the commands supported by the device. If
+	// empty, all the commands in the protocol are supported.
+	Commands []byte
+	// DisconnectOTAAt makes the device drop all its connections the
+	// first time a chunked OTA transfer reaches the given offset, to
+	// simulate a connection loss. Zero disables it.
+	DisconnectOTAAt uint32
+	// Key is the pre-shared key clients must authenticate with.
+	// Nil disables authentication.
+	Key []byte
+	// PublicKey makes the device reject OTA images which are not
+	// signed with the matching private key. Nil accepts any image.
+	PublicKey ed25519.PublicKey
+
+	mu       sync.Mutex
+	started  time.Time
+	ln       net.Listener
+	conns    map[*conn]struct{}
+	server   *mdns.Server
+	config   *protocol.Config
+	coredump []byte
+	image    []byte
+	reboots  int
+	// number of OTA updates failed due to FailOTACount
+	otaFailures int
+	// partial OTA transfer, kept across connections
+	otaSize         uint32
+	otaDigest       [sha256.Size]byte
+	otaData         []byte
+	otaDisconnected bool
+	// signature for the next or current OTA transfer
+	otaSignature *protocol.OTASignatureFrame
+}
+
+// ParsePublicKey decodes an Ed25519 public key in PKIX PEM format, as
+// printed by the key show command, for use as Device.PublicKey
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+	return pub, nil
+}
+
+// New returns a new Device with the given name
+func New(name string) *Device {
+	return &Device{
+		Name:    name,
+		started: time.Now(),
+		conns:   make(map[*conn]struct{}),
+	}
+}
+
+type conn struct {
+	net.Conn
+	mu sync.Mutex
+	// ready is true once the client has authenticated, if required.
+	// Output is only sent to ready connections.
+	ready bool
+	// awaiting is true while the device waits for the client
+	// to decide what to do with the stored coredump
+	awaiting bool
+}
+
+func (c *conn) send(f protocol.Frame) error {
+	var buf bytes.Buffer
+	if err := protocol.Encode(&buf, f); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// Listen starts listening on the given address and serving clients
+// in the background. Use "127.0.0.1:0" to pick a random port.
+func (d *Device) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.ln = ln
+	d.mu.Unlock()
+	go d.serve(ln)
+	return nil
+}
+
+// Addr returns the address the device is listening on
+func (d *Device) Addr() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ln == nil {
+		return ""
+	}
+	return d.ln.Addr().String()
+}
+
+// Advertise announces the device over mDNS. Listen must be
+// called first.
+func (d *Device) Advertise() error {
+	addr := d.Addr()
+	if addr == "" {
+		return errors.New("device is not listening")
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = append(ips, ip)
+	}
+	txt := []string{
+		protocol.TXTChip + "=esp32",
+		protocol.TXTApp + "=fakedevice",
+		protocol.TXTUptime + "=" + strconv.Itoa(int(time.Since(d.started).Seconds())),
+	}
+	if d.FirmwareVersion != "" {
+		txt = append(txt, protocol.TXTFirmwareVersion+"="+d.FirmwareVersion)
+	}
+	svc, err := mdns.NewMDNSService(d.Name, protocol.ServiceName, "", d.Name+".local.", port, ips, txt)
+	if err != nil {
+		return err
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: svc})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.server = server
+	d.mu.Unlock()
+	return nil
+}
+
+// Close stops the device, disconnecting all its clients
+func (d *Device) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.server != nil {
+		d.server.Shutdown()
+		d.server = nil
+	}
+	d.disconnectLocked()
+	if d.ln != nil {
+		err := d.ln.Close()
+		d.ln = nil
+		return err
+	}
+	return nil
+}
+
+func (d *Device) disconnectLocked() {
+	for c := range d.conns {
+		c.Close()
+		delete(d.conns, c)
+	}
+}
+
+// Printf prints to the stdout of the device, sending the output
+// to all connected clients.
+func (d *Device) Printf(format string, args ...interface{}) {
+	d.broadcast(&protocol.PrintFrame{Data: []byte(fmt.Sprintf(format, args...))})
+}
+
+// Eprintf prints to the stderr of the device, sending the output
+// to all connected clients.
+func (d *Device) Eprintf(format string, args ...interface{}) {
+	d.broadcast(&protocol.PrintFrame{Stderr: true, Data: []byte(fmt.Sprintf(format, args...))})
+}
+
+func (d *Device) broadcast(f protocol.Frame) {
+	d.mu.Lock()
+	conns := make([]*conn, 0, len(d.conns))
+	for c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.mu.Unlock()
+	for _, c := range conns {
+		c.mu.Lock()
+		ready := c.ready
+		c.mu.Unlock()
+		if ready {
+			c.send(f)
+		}
+	}
+}
+
+// Config returns the configuration stored in the device, if any
+func (d *Device) Config() *protocol.Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.config
+}
+
+// SetConfig replaces the configuration stored in the device
+func (d *Device) SetConfig(cfg *protocol.Config) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config = cfg
+}
+
+// Coredump returns the coredump stored in the device, if any
+func (d *Device) Coredump() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.coredump
+}
+
+// SetCoredump stores a coredump in the device, which will be offered to
+// the next client that connects. The data must include the leading magic
+// number, as it would be stored in the coredump partition.
+func (d *Device) SetCoredump(data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.coredump = data
+}
+
+// Image returns the last image successfully received via OTA
+func (d *Device) Image() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.image
+}
+
+// Reboots returns how many times the device has been rebooted
+func (d *Device) Reboots() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reboots
+}
+
+func (d *Device) serve(ln net.Listener) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc}
+		d.mu.Lock()
+		d.conns[c] = struct{}{}
+		d.mu.Unlock()
+		go d.handle(c)
+	}
+}
+
+func (d *Device) handle(c *conn) {
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, c)
+		d.mu.Unlock()
+		c.Close()
+	}()
+	if err := d.authenticate(c); err != nil {
+		return
+	}
+	for {
+		f, err := protocol.DecodeRequest(c)
+		if err != nil {
+			if _, ok := err.(*protocol.UnknownCommandError); ok {
+				// The payload length is unknown, so we can't recover
+				c.send(&protocol.PrintFrame{Stderr: true, Data: []byte(err.Error() + "\n")})
+			}
+			return
+		}
+		if err := d.handleFrame(c, f); err != nil {
+			return
+		}
+	}
+}
+
+// authenticate waits for the client to authenticate, if the device
+// has a key, and marks the connection as ready.
+func (d *Device) authenticate(c *conn) error {
+	if d.Key != nil {
+		f, err := protocol.DecodeRequest(c)
+		if err != nil {
+			return err
+		}
+		init, ok := f.(*protocol.AuthInitFrame)
+		if !ok {
+			c.send(&protocol.AuthRequiredFrame{})
+			return errors.New("client did not authenticate")
+		}
+		sconn, err := protocol.ServerHandshake(c.Conn, d.Key, init)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.Conn = sconn
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	c.ready = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (d *Device) supports(cmd byte) bool {
+	var info *protocol.InfoFrame
+	switch {
+	case d.Legacy:
+		info = protocol.LegacyInfo()
+	case len(d.Commands) > 0:
+		info = &protocol.InfoFrame{Commands: d.Commands}
+	default:
+		info = &protocol.InfoFrame{Commands: protocol.Commands()}
+	}
+	return info.Supports(cmd)
+}
+
+func (d *Device) handleFrame(c *conn, f protocol.Frame) error {
+	if !d.supports(f.Cmd()) {
+		if d.Legacy {
+			// Legacy firmware ignores the commands it doesn't know
+			return nil
+		}
+		return c.send(&protocol.PrintFrame{Stderr: true, Data: []byte(fmt.Sprintf("unknown command %d\n", f.Cmd()))})
+	}
+	switch f := f.(type) {
+	case *protocol.HelloFrame:
+		commands := d.Commands
+		if len(commands) == 0 {
+			commands = protocol.Commands()
+		}
+		return c.send(&protocol.InfoFrame{
+			ProtocolVersion: protocol.Version,
+			FirmwareVersion: d.FirmwareVersion,
+			Commands:        commands,
+		})
+	case *protocol.PingFrame:
+		return c.send(&protocol.PongFrame{})
+	case *protocol.RebootFrame:
+		d.reboot()
+		return errors.New("rebooted")
+	case *protocol.OTASignatureFrame:
+		d.mu.Lock()
+		d.otaSignature = f
+		d.mu.Unlock()
+	case *protocol.OTAFrame:
+		return d.receiveOTA(c, f.Data, nil)
+	case *protocol.OTAVerifiedFrame:
+		return d.receiveOTA(c, f.Data, &f.Digest)
+	case *protocol.OTABeginFrame:
+		return c.send(&protocol.OTAProgressFrame{Offset: d.beginOTA(f)})
+	case *protocol.OTAChunkFrame:
+		return d.receiveOTAChunk(c, f.Offset, f.Data)
+	case *protocol.OTAChunkFlateFrame:
+		data, err := f.Decompress()
+		if err != nil {
+			return err
+		}
+		return d.receiveOTAChunk(c, f.Offset, data)
+	case *protocol.ContinueFrame:
+		if c.awaiting {
+			c.awaiting = false
+			return c.send(&protocol.ContinueFrame{})
+		}
+	case *protocol.CoredumpReadFrame:
+		data := d.Coredump()
+		c.awaiting = len(data) > 0
+		return c.send(&protocol.CoredumpFrame{Data: data})
+	case *protocol.CoredumpEraseFrame:
+		d.SetCoredump(nil)
+		return c.send(&protocol.CoredumpEraseFrame{})
+	case *protocol.GetConfigFrame:
+		return c.send(&protocol.ConfigFrame{Config: d.Config()})
+	case *protocol.SetConfigFrame:
+		d.SetConfig(f.Config)
+		return c.send(&protocol.ConfigFrame{Config: f.Config})
+	}
+	return nil
+}
+
+func (d *Device) reboot() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.reboots++
+	d.disconnectLocked()
+}
+
+func (d *Device) receiveOTA(c *conn, data []byte, digest *[sha256.Size]byte) error {
+	for offset := otaProgressStep; offset < len(data); offset += otaProgressStep {
+		if err := c.send(&protocol.OTAProgressFrame{Offset: uint32(offset)}); err != nil {
+			return err
+		}
+	}
+	if err := c.send(&protocol.OTAProgressFrame{Offset: uint32(len(data))}); err != nil {
+		return err
+	}
+	return d.finishOTA(c, data, digest)
+}
+
+// finishOTA verifies and stores a fully received image, replying
+// with the result
+func (d *Device) finishOTA(c *conn, data []byte, digest *[sha256.Size]byte) error {
+	if d.CorruptOTA && len(data) > 0 {
+		data = append([]byte(nil), data...)
+		data[len(data)/2] ^= 0x01
+	}
+	if digest != nil {
+		received := sha256.Sum256(data)
+		if err := c.send(&protocol.OTADigestFrame{Digest: received}); err != nil {
+			return err
+		}
+		if received != *digest {
+			return c.send(&protocol.OTAFailedFrame{})
+		}
+	}
+	d.mu.Lock()
+	signature := d.otaSignature
+	d.otaSignature = nil
+	d.mu.Unlock()
+	if d.PublicKey != nil && (signature == nil || !signature.Verify(d.PublicKey, sha256.Sum256(data))) {
+		if err := c.send(&protocol.OTASignatureInvalidFrame{}); err != nil {
+			return err
+		}
+		return c.send(&protocol.OTAFailedFrame{})
+	}
+	d.mu.Lock()
+	fail := d.FailOTA || d.otaFailures < d.FailOTACount
+	if !d.FailOTA && fail {
+		d.otaFailures++
+	}
+	d.mu.Unlock()
+	if fail {
+		return c.send(&protocol.OTAFailedFrame{})
+	}
+	d.mu.Lock()
+	d.image = data
+	d.mu.Unlock()
+	return c.send(&protocol.OTASuccessFrame{})
+}
+
+func (d *Device) beginOTA(f *protocol.OTABeginFrame) uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if f.Size != d.otaSize || f.Digest != d.otaDigest {
+		// New image, start from scratch
+		d.otaSize = f.Size
+		d.otaDigest = f.Digest
+		d.otaData = nil
+	}
+	return uint32(len(d.otaData))
+}
+
+func (d *Device) receiveOTAChunk(c *conn, offset uint32, chunk []byte) error {
+	d.mu.Lock()
+	if d.otaSize == 0 || offset != uint32(len(d.otaData)) || uint32(len(d.otaData)+len(chunk)) > d.otaSize {
+		// Not expecting this chunk, tell the client where we are
+		committed := uint32(len(d.otaData))
+		d.mu.Unlock()
+		return c.send(&protocol.OTAProgressFrame{Offset: committed})
+	}
+	d.otaData = append(d.otaData, chunk...)
+	committed := uint32(len(d.otaData))
+	disconnect := d.DisconnectOTAAt > 0 && !d.otaDisconnected && committed >= d.DisconnectOTAAt
+	if disconnect {
+		d.otaDisconnected = true
+		d.disconnectLocked()
+	}
+	var data []byte
+	digest := d.otaDigest
+	if committed == d.otaSize {
+		data = d.otaData
+		d.otaSize = 0
+		d.otaData = nil
+	}
+	d.mu.Unlock()
+	if disconnect {
+		return errors.New("disconnected")
+	}
+	if err := c.send(&protocol.OTAProgressFrame{Offset: committed}); err != nil {
+		return err
+	}
+	if data != nil {
+		return d.finishOTA(c, data, &digest)
+	}
+	return nil
+}
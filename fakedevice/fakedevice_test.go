@@ -0,0 +1,49 @@
+package fakedevice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+func TestUnsupportedCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy bool
+		want   byte
+	}{
+		{"legacy", true, protocol.CmdPong},
+		{"current", false, protocol.CmdPrintStderr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New("dev")
+			d.Legacy = tt.legacy
+			d.Commands = []byte{protocol.CmdPing}
+			if err := d.Listen("127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			conn, err := net.Dial("tcp", d.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, f := range []protocol.Frame{&protocol.HelloFrame{}, &protocol.PingFrame{}} {
+				if err := protocol.Encode(conn, f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			f, err := protocol.Decode(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Cmd() != tt.want {
+				t.Errorf("first reply is %s, want %s", protocol.CommandName(f.Cmd()), protocol.CommandName(tt.want))
+			}
+		})
+	}
+}
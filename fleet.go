@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// otaRetryDelay is the time to wait before retrying a failed update
+	otaRetryDelay = time.Second
+	// fleetProgressStep is the Client.OTAProgressStep used when flashing
+	// several hosts at once, since their progress lines are interleaved
+	fleetProgressStep = 10
+)
+
+// flashTarget is a host to be flashed by flashHosts
+type flashTarget struct {
+	// name identifies the host in the summary. It's taken from
+	// the host selection, since the client might never connect.
+	name   string
+	client *Client
+}
+
+// flashResult is the result of flashing the image to a host
+type flashResult struct {
+	host     string
+	attempts int
+	elapsed  time.Duration
+	err      error
+}
+
+// isRetryableOTAError returns true if an update which failed
+// with err might succeed when retried
+func isRetryableOTAError(err error) bool {
+	if err == ErrOTAFailed {
+		return true
+	}
+	_, ok := err.(*OTADigestMismatchError)
+	return ok
+}
+
+// flashFile flashes the image stored in bin to the host
+func flashFile(ctx context.Context, c *Client, bin string) error {
+	f, err := os.Open(bin)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Flash(ctx, f)
+}
+
+// flashWithRetries flashes bin to the host, retrying up to retries
+// times if the host reports that the update failed. It returns the
+// number of attempts and the error from the last one.
+func flashWithRetries(ctx context.Context, c *Client, bin string, retries int) (int, error) {
+	attempts := 1
+	for {
+		err := flashFile(ctx, c, bin)
+		if err == nil || !isRetryableOTAError(err) || attempts > retries {
+			return attempts, err
+		}
+		attempts++
+		fmt.Fprintf(c.Stdout(), "retrying OTA (attempt %d of %d)...\n", attempts, retries+1)
+		select {
+		case <-time.After(otaRetryDelay):
+		case <-ctx.Done():
+			return attempts - 1, ctx.Err()
+		}
+	}
+}
+
+// flashHosts flashes bin to all the targets, at most concurrency of them
+// at the same time. If prepare is not nil, it's called before flashing
+// each client, e.g. to connect it. The results are returned in the same
+// order as the targets.
+func flashHosts(ctx context.Context, targets []*flashTarget, bin string, concurrency int, retries int, prepare func(*Client) error) []*flashResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]*flashResult, len(targets))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for ii, t := range targets {
+		wg.Add(1)
+		go func(ii int, t *flashTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res := &flashResult{host: t.name}
+			start := time.Now()
+			if prepare != nil {
+				res.err = prepare(t.client)
+			}
+			if res.err == nil {
+				res.attempts, res.err = flashWithRetries(ctx, t.client, bin, retries)
+			}
+			res.elapsed = time.Since(start)
+			results[ii] = res
+		}(ii, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// printFlashSummary prints a table with the results, returning
+// the number of hosts which failed
+func printFlashSummary(w io.Writer, results []*flashResult) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Host\tResult\tAttempts\tTime\tError\n")
+	for _, v := range results {
+		result, errMsg := "ok", "-"
+		if v.err != nil {
+			failed++
+			result, errMsg = "FAILED", v.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%s\n", v.host, result, v.attempts, roundDuration(v.elapsed), errMsg)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d hosts flashed, %d failed\n", len(results)-failed, failed)
+	return failed
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+)
+
+func TestFlashHosts(t *testing.T) {
+	image := testImage(50000)
+	f, err := ioutil.TempFile("", "app.*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(image)
+	f.Close()
+
+	ok := startDevice(t, fakedevice.New("ok"))
+	defer ok.Close()
+	failing := fakedevice.New("failing")
+	failing.FailOTA = true
+	startDevice(t, failing)
+	defer failing.Close()
+	// Reserve a port and close it, so connecting fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := ln.Addr().String()
+	ln.Close()
+
+	hosts := []*Host{
+		{Host: "ok", Addrs: []string{ok.Addr()}},
+		{Host: "failing", Addrs: []string{failing.Addr()}},
+		{Host: "unreachable", Addrs: []string{unreachable}},
+	}
+	var targets []*flashTarget
+	for _, v := range hosts {
+		c := NewClient(&ProjectInfo{}, strings.NewReader(""), ioutil.Discard, ioutil.Discard)
+		c.Host = v
+		targets = append(targets, &flashTarget{name: v.Host, client: c})
+	}
+	results := flashHosts(context.Background(), targets, f.Name(), 2, 1, func(c *Client) error {
+		if err := c.Connect(context.Background()); err != nil {
+			return err
+		}
+		go c.Run(context.Background())
+		return c.WaitHandshake(context.Background())
+	})
+	for _, v := range targets {
+		v.client.Close()
+	}
+
+	want := []struct {
+		host     string
+		attempts int
+		failed   bool
+	}{
+		{"ok", 1, false},
+		{"failing", 2, true},
+		{"unreachable", 0, true},
+	}
+	for ii, w := range want {
+		res := results[ii]
+		if res.host != w.host || res.attempts != w.attempts || (res.err != nil) != w.failed {
+			t.Errorf("result %d = %+v, want host %s, %d attempts, failed = %v", ii, res, w.host, w.attempts, w.failed)
+		}
+	}
+	if !bytes.Equal(ok.Image(), image) {
+		t.Error("image was not flashed")
+	}
+	var summary bytes.Buffer
+	if failed := printFlashSummary(&summary, results); failed != 2 {
+		t.Errorf("printFlashSummary() = %d, want 2", failed)
+	}
+	if !strings.Contains(summary.String(), "unreachable") {
+		t.Errorf("summary doesn't include the unreachable host:\n%s", summary.String())
+	}
+}
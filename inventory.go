@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// InventoryDevice is a device listed in the inventory file
+type InventoryDevice struct {
+	Name string `json:"name"`
+	// Address is either an IP address or a host name, optionally
+	// followed by the port
+	Address string `json:"address"`
+	Port    int    `json:"port,omitempty"`
+	// Project is the path to the project running in the device,
+	// relative to the inventory file
+	Project string `json:"project,omitempty"`
+	// Key is the pre-shared key of the device, encoded in hex
+	Key string `json:"key,omitempty"`
+}
+
+// Inventory lists devices which can't be found over mDNS, e.g. because
+// they're in a different network. It's stored as JSON:
+//
+//	{
+//	  "devices": [
+//	    {"name": "lab-1", "address": "10.0.1.20", "port": 8888, "project": "../firmware"}
+//	  ]
+//	}
+type Inventory struct {
+	Devices []*InventoryDevice `json:"devices"`
+}
+
+// LoadInventory reads the inventory file at path. A missing file
+// results in an empty inventory.
+func LoadInventory(path string) (*Inventory, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Inventory{}, nil
+		}
+		return nil, err
+	}
+	inv := &Inventory{}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("error decoding inventory %s: %v", path, err)
+	}
+	seen := make(map[string]bool)
+	for ii, v := range inv.Devices {
+		if v.Name == "" {
+			return nil, fmt.Errorf("%s: device %d has no name", path, ii+1)
+		}
+		name := normalizeHostName(v.Name)
+		if seen[name] {
+			return nil, fmt.Errorf("%s: duplicate device %s", path, v.Name)
+		}
+		seen[name] = true
+		if _, err := v.Addr(); err != nil {
+			return nil, fmt.Errorf("%s: device %s: %v", path, v.Name, err)
+		}
+		if _, err := v.key(); err != nil {
+			return nil, fmt.Errorf("%s: device %s: %v", path, v.Name, err)
+		}
+		if v.Project != "" && !filepath.IsAbs(v.Project) {
+			v.Project = filepath.Join(filepath.Dir(path), v.Project)
+		}
+	}
+	return inv, nil
+}
+
+// Find returns the device with the given name, or nil if there's none
+func (inv *Inventory) Find(name string) *InventoryDevice {
+	if inv == nil || name == "" {
+		return nil
+	}
+	name = normalizeHostName(name)
+	for _, v := range inv.Devices {
+		if normalizeHostName(v.Name) == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys of the devices in the inventory
+func (inv *Inventory) Keys() HostKeys {
+	keys := make(HostKeys)
+	for _, v := range inv.Devices {
+		// Keys were validated by LoadInventory
+		if key, _ := v.key(); key != nil {
+			keys[normalizeHostName(v.Name)] = key
+		}
+	}
+	return keys
+}
+
+// Addr returns the address of the device in host:port format
+func (d *InventoryDevice) Addr() (string, error) {
+	if d.Address == "" {
+		return "", errors.New("missing address")
+	}
+	if d.Port == 0 {
+		if _, _, err := net.SplitHostPort(d.Address); err != nil {
+			return "", errors.New("missing port")
+		}
+		return d.Address, nil
+	}
+	if d.Port < 0 || d.Port > 65535 {
+		return "", fmt.Errorf("invalid port %d", d.Port)
+	}
+	return net.JoinHostPort(d.Address, strconv.Itoa(d.Port)), nil
+}
+
+// Host returns the Host for connecting to the device
+func (d *InventoryDevice) Host() *Host {
+	// Address was validated by LoadInventory
+	addr, _ := d.Addr()
+	return &Host{
+		Host:  d.Name,
+		Addrs: []string{addr},
+	}
+}
+
+func (d *InventoryDevice) key() ([]byte, error) {
+	if d.Key == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(d.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(key) < protocol.MinKeySize {
+		return nil, fmt.Errorf("key must be at least %d bytes", protocol.MinKeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micro/mdns"
+)
+
+func writeInventory(t *testing.T, dir string, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeInventory(t, dir, `{"devices": [
+		{"name": "lab-1", "address": "10.0.1.20", "port": 8888, "project": "../firmware", "key": "000102030405060708090a0b0c0d0e0f"},
+		{"name": "lab-2.local.", "address": "lab-2.example.com:9999"}
+	]}`)
+	inv, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lab1 := inv.Find("LAB-1.local.")
+	if lab1 == nil {
+		t.Fatal("lab-1 not found")
+	}
+	if want := filepath.Join(dir, "..", "firmware"); lab1.Project != want {
+		t.Errorf("project = %q, want %q", lab1.Project, want)
+	}
+	if want := (&Host{Host: "lab-1", Addrs: []string{"10.0.1.20:8888"}}); !reflect.DeepEqual(lab1.Host(), want) {
+		t.Errorf("Host() = %+v, want %+v", lab1.Host(), want)
+	}
+	if lab2 := inv.Find("lab-2"); lab2 == nil || lab2.Host().Addrs[0] != "lab-2.example.com:9999" {
+		t.Errorf("Find(lab-2) = %+v", lab2)
+	}
+	if dev := inv.Find("lab"); dev != nil {
+		t.Errorf("Find(lab) = %+v, want nil", dev)
+	}
+	keys := inv.Keys()
+	if len(keys) != 1 || len(keys["lab-1"]) != 16 {
+		t.Errorf("Keys() = %v", keys)
+	}
+
+	inv, err = LoadInventory(filepath.Join(dir, "missing.json"))
+	if err != nil || len(inv.Devices) != 0 {
+		t.Errorf("LoadInventory() with a missing file = %v, %v, want an empty inventory", inv, err)
+	}
+}
+
+func TestLoadInventoryInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"invalid JSON", `{"devices": [`, "error decoding"},
+		{"no name", `{"devices": [{"address": "10.0.0.1:8888"}]}`, "device 1 has no name"},
+		{"duplicate", `{"devices": [{"name": "a", "address": "10.0.0.1:8888"}, {"name": "A.local", "address": "10.0.0.2:8888"}]}`, "duplicate device"},
+		{"no address", `{"devices": [{"name": "a"}]}`, "missing address"},
+		{"no port", `{"devices": [{"name": "a", "address": "10.0.0.1"}]}`, "missing port"},
+		{"invalid port", `{"devices": [{"name": "a", "address": "10.0.0.1", "port": 70000}]}`, "invalid port"},
+		{"invalid key", `{"devices": [{"name": "a", "address": "10.0.0.1:8888", "key": "xyz"}]}`, "invalid key"},
+		{"short key", `{"devices": [{"name": "a", "address": "10.0.0.1:8888", "key": "0102"}]}`, "key must be at least"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadInventory(writeInventory(t, dir, tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("LoadInventory() error = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func testInventory() *Inventory {
+	return &Inventory{Devices: []*InventoryDevice{
+		{Name: "lab-1", Address: "10.0.1.20:8888"},
+		{Name: "lab-2", Address: "10.0.1.21:8888"},
+		{Name: "office", Address: "10.0.2.20:8888"},
+	}}
+}
+
+func hostNames(hosts []*Host) []string {
+	var names []string
+	for _, v := range hosts {
+		names = append(names, v.Host)
+	}
+	return names
+}
+
+func TestScannerHostsInventory(t *testing.T) {
+	defer stubMDNS([]*mdns.ServiceEntry{
+		{Host: "lab-1.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 10}},
+		{Host: "lab-3.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 11}},
+		{Host: "other.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 12}},
+	}, nil)()
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		// lab-1 is found over mDNS too, but the inventory takes precedence
+		{"lab", []string{"lab-1", "lab-2", "lab-3.local."}},
+		{"LAB-3.local.", []string{"lab-3.local."}},
+		{"office", []string{"office"}},
+		{"", []string{"lab-1", "lab-2", "office", "lab-3.local.", "other.local."}},
+	}
+	for _, tt := range tests {
+		s := NewScanner(tt.filter, false, nil, ioutil.Discard, nil)
+		s.Inventory = testInventory()
+		hosts, err := s.Hosts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hostNames(hosts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Hosts() with filter %q = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestScannerHostsInventoryWithoutMDNS(t *testing.T) {
+	mdnsErr := errors.New("no route to host")
+	defer stubMDNS(nil, mdnsErr)()
+	s := NewScanner("lab", false, nil, ioutil.Discard, nil)
+	s.Inventory = testInventory()
+	hosts, err := s.Hosts()
+	if err != nil {
+		t.Fatalf("Hosts() = %v, want the inventory hosts", err)
+	}
+	if got, want := hostNames(hosts), []string{"lab-1", "lab-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Hosts() = %v, want %v", got, want)
+	}
+	host, err := NewScanner("office", false, nil, ioutil.Discard, nil).Find(0)
+	if err == nil {
+		t.Errorf("Find() without inventory = %v, want an error", host)
+	}
+	s = NewScanner("missing", false, nil, ioutil.Discard, nil)
+	s.Inventory = testInventory()
+	if _, err := s.Hosts(); err != mdnsErr {
+		t.Errorf("Hosts() with no inventory matches = %v, want %v", err, mdnsErr)
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	tests := []struct {
+		addr   string
+		policy AddressPolicy
+		want   *Host
+		err    string
+	}{
+		{addr: "127.0.0.1:8888", want: &Host{Host: "127.0.0.1", Addrs: []string{"127.0.0.1:8888"}}},
+		{addr: "[::1]:8888", policy: PreferIPv6, want: &Host{Host: "::1", Addrs: []string{"[::1]:8888"}}},
+		{addr: "[fe80::1%lo]:8888", want: &Host{Host: "fe80::1%lo", Addrs: []string{"[fe80::1%lo]:8888"}}},
+		{addr: "127.0.0.1", err: "must be host:port"},
+		{addr: "127.0.0.1:99999", err: "invalid port"},
+		{addr: "host.invalid:8888", err: "error resolving host.invalid"},
+	}
+	for _, tt := range tests {
+		host, err := ResolveHost(tt.addr, tt.policy, time.Second)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ResolveHost(%q) = %v, %v, want an error containing %q", tt.addr, host, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(host, tt.want) {
+			t.Errorf("ResolveHost(%q) = %+v, %v, want %+v", tt.addr, host, err, tt.want)
+		}
+	}
+}
@@ -4,10 +4,9 @@ import (
 	"io"
 	"os"
 	"sync"
-	"syscall"
+	"time"
 
 	"github.com/pkg/term"
-	"github.com/pkg/term/termios"
 )
 
 const (
@@ -15,6 +14,10 @@ const (
 	kmArrowRight = 253
 	kmArrowDown  = 254
 	kmArrowUp    = 255
+
+	// kmReadTimeout is the maximum time Get blocks while
+	// no keys are pressed
+	kmReadTimeout = 100 * time.Millisecond
 )
 
 var (
@@ -24,7 +27,14 @@ var (
 type keyboardMonitor struct {
 	t     *term.Term
 	isRaw bool
-	mu    sync.Mutex
+	// paused is the number of Pause calls without a matching Resume
+	paused int
+	// reading is true while Get is reading from the terminal
+	reading bool
+	mu      sync.Mutex
+	// changed is signaled when the terminal is set to raw mode,
+	// Get stops reading or the monitor is resumed
+	changed *sync.Cond
 }
 
 func (km *keyboardMonitor) Open() error {
@@ -40,41 +50,52 @@ func (km *keyboardMonitor) Open() error {
 	if err := km.t.SetRaw(); err != nil {
 		return err
 	}
+	// Return from reads periodically, so Get doesn't keep
+	// the terminal in raw mode indefinitely
+	if err := km.t.SetReadTimeout(kmReadTimeout); err != nil {
+		return err
+	}
 	km.isRaw = true
+	km.changedCond().Broadcast()
 	return nil
 }
 
+// changedCond must be called with km.mu held
+func (km *keyboardMonitor) changedCond() *sync.Cond {
+	if km.changed == nil {
+		km.changed = sync.NewCond(&km.mu)
+	}
+	return km.changed
+}
+
+// Get waits for a key press, blocking while the terminal is not in raw
+// mode or the monitor is paused. It returns zero if no key is pressed
+// for kmReadTimeout.
 func (km *keyboardMonitor) Get() (byte, error) {
 	km.mu.Lock()
+	for km.t == nil || !km.isRaw || km.paused > 0 {
+		km.changedCond().Wait()
+	}
 	t := km.t
-	isRaw := km.isRaw
+	km.reading = true
 	km.mu.Unlock()
-	if t != nil && isRaw {
-		buf := make([]byte, 3)
-		// We can't use t.SetReadTimeout() because zero
-		// disables timeouts
-		var tios syscall.Termios
-		if err := termios.Tcgetattr(0, &tios); err != nil {
-			panic(err)
-		}
-		tios.Cc[syscall.VMIN], tios.Cc[syscall.VTIME] = 0, 0
-		if err := termios.Tcsetattr(0, termios.TCSANOW, &tios); err != nil {
-			panic(err)
-		}
-		n, err := t.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				return 0, nil
-			}
-			return 0, err
-		}
-		if n == 3 && buf[0] == 27 && buf[1] == 91 {
-			// Arrow key
-			return 255 - (buf[2] - 65), nil
+	buf := make([]byte, 3)
+	n, err := t.Read(buf)
+	km.mu.Lock()
+	km.reading = false
+	km.changedCond().Broadcast()
+	km.mu.Unlock()
+	if err != nil {
+		if err == io.EOF {
+			return 0, nil
 		}
-		return buf[0], nil
+		return 0, err
 	}
-	return 0, nil
+	if n == 3 && buf[0] == 27 && buf[1] == 91 {
+		// Arrow key
+		return 255 - (buf[2] - 65), nil
+	}
+	return buf[0], nil
 }
 
 func (km *keyboardMonitor) Close() error {
@@ -89,8 +110,30 @@ func (km *keyboardMonitor) Close() error {
 	return nil
 }
 
+// Pause stops Get from reading keys until Resume is called, so the
+// terminal input can be read by someone else, e.g. to prompt the user.
+// It waits for the read in progress, if any, to finish.
+func (km *keyboardMonitor) Pause() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.paused++
+	for km.reading {
+		km.changedCond().Wait()
+	}
+}
+
+// Resume undoes a previous call to Pause
+func (km *keyboardMonitor) Resume() {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	km.paused--
+	km.changedCond().Broadcast()
+}
+
 func (km *keyboardMonitor) RunPaused(fn func()) {
-	wasOpen := km.t != nil
+	km.mu.Lock()
+	wasOpen := km.isRaw
+	km.mu.Unlock()
 	if wasOpen {
 		if err := km.Close(); err != nil {
 			panic(err)
@@ -154,7 +197,7 @@ func (km *keyboardMonitor) Start() <-chan byte {
 	go func() {
 		for {
 			k, err := km.Get()
-			if err == nil {
+			if err == nil && k != 0 {
 				input <- k
 			}
 		}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// hostKeysWildcard matches any host without its own key
+const hostKeysWildcard = "*"
+
+// HostKeys maps host names to their pre-shared keys
+type HostKeys map[string][]byte
+
+// normalizeHostName allows using either "name", "name.local" or
+// "name.local." to refer to the same host
+func normalizeHostName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return strings.TrimSuffix(name, ".local")
+}
+
+// LoadHostKeys reads the keys from the file at path. Each non empty line
+// contains a host name followed by its key encoded in hex, separated by
+// whitespace. Lines starting with # are ignored. A host name of *
+// matches any host without its own key. A missing file is not an error.
+func LoadHostKeys(path string) (HostKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(HostKeys)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expecting host and key", path, line)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %v", path, line, err)
+		}
+		if len(key) < protocol.MinKeySize {
+			return nil, fmt.Errorf("%s:%d: key must be at least %d bytes", path, line, protocol.MinKeySize)
+		}
+		keys[normalizeHostName(fields[0])] = key
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Lookup returns the key for the given host, or nil if there's none
+func (k HostKeys) Lookup(host string) []byte {
+	if key := k[normalizeHostName(host)]; key != nil {
+		return key
+	}
+	return k[hostKeysWildcard]
+}
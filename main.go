@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,35 +10,97 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 )
 
 var (
-	projectPathArg    = flag.String("p", ".", "Path to the project directory")
-	hostArg           = flag.String("host", "", "Host to connect to, leave empty for scanning")
-	nonInteractiveArg = flag.Bool("n", false, "Non interactive")
-	makefiles         = flag.String("m", "Makefile", "Name of the Makefile to use to load the app information (relative to project directory)")
+	projectPathArg       = flag.String("p", "", "Path to the project directory (default is the project of the host in the inventory, if any, or the current directory)")
+	hostArg              = flag.String("host", "", "Host to connect to, either a name from the inventory or a filter for the hosts found over mDNS. Leave empty for scanning")
+	addrArg              = flag.String("addr", "", "Address to connect to directly in host:port format, without scanning. The host can be an IP address or a DNS name")
+	connectTimeoutArg    = flag.Duration("connect-timeout", dialTimeout, "Timeout for resolving and connecting to the host")
+	inventoryArg         = flag.String("inventory", filepath.Join(".wmonitor", "inventory.json"), "JSON file listing hosts which can't be found over mDNS")
+	nonInteractiveArg    = flag.Bool("n", false, "Non interactive")
+	preferArg            = flag.String("prefer", "ipv4", "Preferred address family when a host has both IPv4 and IPv6 addresses: ipv4 or ipv6")
+	timeoutArg           = flag.Duration("timeout", 30*time.Second, "Timeout for finding the host and waiting for its replies, used by all commands except monitor")
+	makefiles            = flag.String("m", "Makefile", "Name of the Makefile to use to load the app information (relative to project directory)")
+	buildSystemArg       = flag.String("b", "auto", "Build system used by the project: auto, make or cmake")
+	buildDirArg          = flag.String("B", "build", "Build directory for CMake projects (relative to project directory)")
+	decodeArg            = flag.Bool("d", true, "Decode code addresses in the output using the app ELF")
+	otaRateArg           = flag.Int("ota-rate", 0, "Maximum OTA upload rate in bytes per second, 0 for no limit")
+	reconnectDelayArg    = flag.Duration("reconnect-delay", time.Second, "Delay before reconnecting after losing the connection to the host, doubled after each failed attempt")
+	reconnectMaxDelayArg = flag.Duration("reconnect-max-delay", 30*time.Second, "Maximum delay between reconnection attempts, 0 for no limit")
+	reconnectJitterArg   = flag.Float64("reconnect-jitter", 0.2, "Fraction of the reconnection delay to randomize, between 0 and 1")
+	reconnectAttemptsArg = flag.Int("reconnect-attempts", 0, "Number of reconnection attempts before giving up, 0 for no limit")
+	reconnectTimeoutArg  = flag.Duration("reconnect-timeout", 0, "Time without a connection to the host before giving up, 0 for no limit")
+	otaConcurrencyArg    = flag.Int("ota-concurrency", 4, "Maximum number of hosts to flash at the same time")
+	otaRetriesArg        = flag.Int("ota-retries", 2, "Number of times to retry an OTA update when the host reports a failure")
+	compressOTAArg       = flag.Bool("z", true, "Compress OTA uploads, if supported by the host")
+	keysArg              = flag.String("keys", filepath.Join(".wmonitor", "keys"), "File with the pre-shared keys for the hosts (relative to project directory)")
+	signKeyArg           = flag.String("sign-key", filepath.Join(".wmonitor", "signing.pem"), "Ed25519 private key used to sign OTA images, if it exists (relative to project directory)")
+	coreDumpDirArg       = flag.String("coredumps", filepath.Join(".wmonitor", "coredumps"), "Directory to archive coredumps in (relative to project directory), empty to disable")
+)
+
+const (
+	buildSystemMake  = "make"
+	buildSystemCMake = "cmake"
 )
 
 type ProjectInfo struct {
-	Path    string
-	IDFPath string
-	AppElf  string
-	AppBin  string
+	Path        string
+	BuildSystem string
+	BuildDir    string
+	IDFPath     string
+	AppElf      string
+	AppBin      string
+}
+
+// BuildCommand returns the command that rebuilds the app binary
+func (info *ProjectInfo) BuildCommand() *exec.Cmd {
+	if info.BuildSystem == buildSystemCMake {
+		return cmakeBuildCommand(info)
+	}
+	cmd := exec.Command("make", info.AppBin)
+	cmd.Dir = info.Path
+	return cmd
 }
 
-func handleInput(km *keyboardMonitor, ch chan<- byte) {
-	for {
-		b, err := km.Get()
+func findProjectInfo(projectPath string) (*ProjectInfo, error) {
+	buildDir := *buildDirArg
+	if !filepath.IsAbs(buildDir) {
+		buildDir = filepath.Join(projectPath, buildDir)
+	}
+	buildSystem := *buildSystemArg
+	if buildSystem == "auto" {
+		buildSystem = buildSystemMake
+		makefile := strings.Split(*makefiles, ",")[0]
+		if isCMakeProject(projectPath, buildDir, makefile) {
+			buildSystem = buildSystemCMake
+		}
+	}
+	switch buildSystem {
+	case buildSystemMake:
+		return findMakeProjectInfo(projectPath)
+	case buildSystemCMake:
+		desc, err := ReadProjectDescription(projectPath, buildDir)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		ch <- b
+		if desc.IDFPath == "" {
+			return nil, errors.New("could not determine IDF_PATH")
+		}
+		return &ProjectInfo{
+			Path:        projectPath,
+			BuildSystem: buildSystemCMake,
+			BuildDir:    desc.BuildDir,
+			IDFPath:     desc.IDFPath,
+			AppElf:      desc.AppElf,
+			AppBin:      desc.AppBin,
+		}, nil
 	}
+	return nil, fmt.Errorf("invalid build system %q", buildSystem)
 }
 
-func findProjectInfo(projectPath string) (*ProjectInfo, error) {
+func findMakeProjectInfo(projectPath string) (*ProjectInfo, error) {
 	var makefilePaths []string
 	for _, v := range strings.Split(*makefiles, ",") {
 		makefilePaths = append(makefilePaths, filepath.Join(projectPath, v))
@@ -53,144 +116,136 @@ func findProjectInfo(projectPath string) (*ProjectInfo, error) {
 		}
 	}
 	return &ProjectInfo{
-		Path:    projectPath,
-		IDFPath: vars["IDF_PATH"],
-		AppElf:  vars["APP_ELF"],
-		AppBin:  vars["APP_BIN"],
+		Path:        projectPath,
+		BuildSystem: buildSystemMake,
+		IDFPath:     vars["IDF_PATH"],
+		AppElf:      vars["APP_ELF"],
+		AppBin:      vars["APP_BIN"],
 	}, nil
 }
 
-func handleServer(hostFilter string, interactive bool, c *Client, ch chan<- error) {
-	hostCh := make(chan *Host, 1)
-	s := NewScanner(hostFilter, interactive, c.Stdin(), c.Stdout(), hostCh)
-	s.Scan()
-	host := <-hostCh
+// loadInventory loads the inventory file. Its path is relative to
+// the directory given with -p, rather than projectPath(), since the
+// project might be determined by the inventory.
+func loadInventory() (*Inventory, error) {
+	path := *inventoryArg
+	if path == "" {
+		return &Inventory{}, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(*projectPathArg, path)
+	}
+	return LoadInventory(path)
+}
 
-	c.Host = host
-	if err := c.Connect(); err != nil {
-		ch <- err
-		return
+// directHost returns the host given with -addr, resolving its
+// address, or nil if -addr was not given
+func directHost(policy AddressPolicy) (*Host, error) {
+	if *addrArg == "" {
+		return nil, nil
 	}
-	fmt.Fprintf(c.Stdout(), "connected to %s\n", host.Host)
-	defer c.Close()
+	if *hostArg != "" {
+		return nil, usageErrorf("-addr and -host can't be used together")
+	}
+	return ResolveHost(*addrArg, policy, *connectTimeoutArg)
+}
 
-	err := c.Run()
-	ch <- err
+// reconnectPolicy returns the ReconnectPolicy configured
+// from the command line flags
+func reconnectPolicy() (*ReconnectPolicy, error) {
+	p := &ReconnectPolicy{
+		Delay:       *reconnectDelayArg,
+		MaxDelay:    *reconnectMaxDelayArg,
+		Jitter:      *reconnectJitterArg,
+		MaxAttempts: *reconnectAttemptsArg,
+		Timeout:     *reconnectTimeoutArg,
+	}
+	if err := p.Validate(); err != nil {
+		return nil, usageError(err.Error())
+	}
+	return p, nil
 }
 
-func flash(km *keyboardMonitor, c *Client) error {
-	// Compile
-	info := c.ProjectInfo()
-	compileCmd := exec.Command("make", info.AppBin)
-	compileCmd.Dir = info.Path
-	compileCmd.Stdout = km.Stdout()
-	compileCmd.Stderr = km.Stderr()
-	if err := compileCmd.Run(); err != nil {
-		return errors.New("compilation failed")
-	}
-	return c.Flash(info.AppBin)
+// projectPath returns the path to the project directory
+func projectPath() string {
+	if *projectPathArg != "" {
+		return *projectPathArg
+	}
+	// Errors are reported when resolving the host
+	if inv, err := loadInventory(); err == nil {
+		if dev := inv.Find(*hostArg); dev != nil && dev.Project != "" {
+			return dev.Project
+		}
+	}
+	return "."
 }
 
-func main() {
-	flag.Parse()
+// projectRelative returns path relative to the project
+// directory, unless it's absolute or empty
+func projectRelative(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(projectPath(), path)
+}
 
-	info, err := findProjectInfo(*projectPathArg)
+// newClient returns a Client configured from the command line flags
+func newClient(info *ProjectInfo, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*Client, error) {
+	keys, err := LoadHostKeys(projectRelative(*keysArg))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	km := &keyboardMonitor{}
-	inputCh := make(chan byte, 1)
-
-	var stdin io.Reader = os.Stdin
-	var stdout io.Writer = os.Stdout
-	var stderr io.Writer = os.Stderr
-
-	if !*nonInteractiveArg {
-		if err := km.Open(); err != nil {
-			panic(err)
+	inv, err := loadInventory()
+	if err != nil {
+		return nil, err
+	}
+	// Keys in the inventory take precedence
+	if invKeys := inv.Keys(); len(invKeys) > 0 {
+		if keys == nil {
+			keys = make(HostKeys)
+		}
+		for k, v := range invKeys {
+			keys[k] = v
+		}
+	}
+	var signingKey ed25519.PrivateKey
+	if path := projectRelative(*signKeyArg); path != "" {
+		if signingKey, err = LoadSigningKey(path); err != nil {
+			return nil, err
 		}
-		defer km.Close()
-		go handleInput(km, inputCh)
-		stdin = km.Stdin()
-		stdout = km.Stdout()
-		stderr = km.Stderr()
 	}
+	c := NewClient(info, stdin, stdout, stderr)
+	c.DecodeAddresses = *decodeArg
+	c.CoreDumpDir = projectRelative(*coreDumpDirArg)
+	c.MaxOTARate = *otaRateArg
+	c.DialTimeout = *connectTimeoutArg
+	c.CompressOTA = *compressOTAArg
+	c.Keys = keys
+	c.SigningKey = signingKey
+	return c, nil
+}
 
-	clientCh := make(chan error, 1)
+func main() {
+	flag.Usage = usage
+	flag.Parse()
 
-	hostFilter := *hostArg
-	c := NewClient(info, stdin, stdout, stderr)
-	for {
-		go handleServer(hostFilter, !*nonInteractiveArg, c, clientCh)
-	PollingLoop:
-		for {
-			select {
-			case input := <-inputCh:
-				switch input {
-				case kmSigInt:
-					km.Close()
-					syscall.Kill(syscall.Getpid(), syscall.SIGINT)
-				case 'c':
-					// Ask the user for the new configuration
-					c.GetConfig(func(cfg *HostConfig) {
-						c.PromptUser("Select Wi-Fi mode [(A)uto/(s)tation/(h)ost]: ", func(s string) bool {
-							switch s {
-							case "", "a", "A":
-								cfg.WifiMode = WifiModeAuto
-							case "S", "s":
-								cfg.WifiMode = WifiModeSTA
-							case "h", "H":
-								cfg.WifiMode = WifiModeAP
-							default:
-								return false
-							}
-							return true
-						})
-						c.PromptUser("Enter Wi-Fi SSID: ", func(s string) bool {
-							cfg.WifiSSID = s
-							return true
-						})
-						c.PromptUser("Enter Wi-Fi Password: ", func(s string) bool {
-							cfg.WifiPassword = s
-							c.SetConfig(cfg)
-							return true
-						})
-					})
-				case 'f':
-					fmt.Fprintf(stdout, "flashing %s to host...\n", filepath.Base(info.AppBin))
-					go func() {
-						// Run this in a goroutine, since uploading will block
-						// in order to ratelimit
-						if err := flash(km, c); err != nil {
-							fmt.Fprintf(stdout, "error flashing: %v\n", err)
-						}
-					}()
-				case 'r':
-					// Reboot the board
-					if err := c.Reboot(); err != nil {
-						fmt.Fprintf(stdout, "error rebooting host: %v\n", err)
-					}
-				case 'q':
-					// Quit
-					c.Close()
-					return
-				}
-			case err := <-clientCh:
-				if err != nil {
-					if !*nonInteractiveArg && c.Host != nil && c.Host.Host != "" {
-						// Try to reconnect
-						hostFilter = c.Host.Host
-						fmt.Fprintf(stdout, "disconnected from %s, trying to reconnect...\n", c.Host.Host)
-						break PollingLoop
-					}
-					panic(err)
-				}
-				// non-nil err, requested exit
-				return
-			default:
-				time.Sleep(5 * time.Millisecond)
-			}
+	name := "monitor"
+	args := flag.Args()
+	if len(args) > 0 {
+		name = args[0]
+		args = args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+	if err := cmd.run(newCommandFlagSet(cmd), args); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if _, ok := err.(usageError); ok {
+			os.Exit(exitUsage)
 		}
+		os.Exit(exitFailure)
 	}
 }
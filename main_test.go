@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+)
+
+func TestDirectHost(t *testing.T) {
+	prevHost, prevAddr := *hostArg, *addrArg
+	defer func() {
+		*hostArg, *addrArg = prevHost, prevAddr
+	}()
+	*hostArg, *addrArg = "", ""
+	if host, err := directHost(PreferIPv4); host != nil || err != nil {
+		t.Errorf("directHost() without -addr = %v, %v, want nil", host, err)
+	}
+	*hostArg, *addrArg = "dev", "127.0.0.1:8888"
+	if _, err := directHost(PreferIPv4); err == nil {
+		t.Error("directHost() with -host and -addr = nil, want an error")
+	} else if _, ok := err.(usageError); !ok {
+		t.Errorf("directHost() with -host and -addr = %v, want a usage error", err)
+	}
+	*hostArg, *addrArg = "", "127.0.0.1"
+	if _, err := directHost(PreferIPv4); err == nil {
+		t.Error("directHost() without port = nil, want an error")
+	}
+
+	// Connect to the device without scanning
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	*addrArg = d.Addr()
+	host, err := directHost(PreferIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{d.Addr()}; !reflect.DeepEqual(host.Addrs, want) {
+		t.Errorf("directHost() = %v, want %v", host.Addrs, want)
+	}
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), ioutil.Discard, ioutil.Discard)
+	c.Host = host
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Run(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitHandshake(ctx); err != nil {
+		t.Error(err)
+	}
+}
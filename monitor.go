@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+func handleInput(km *keyboardMonitor, ch chan<- byte) {
+	for {
+		b, err := km.Get()
+		if err != nil {
+			panic(err)
+		}
+		if b != 0 {
+			ch <- b
+		}
+	}
+}
+
+// connectError is reported by a session when connecting to the
+// host fails, as opposed to losing an established connection
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+// configTimeout is the time to wait for the host to reply
+// to configuration requests in monitor
+const configTimeout = 10 * time.Second
+
+func flash(ctx context.Context, km *keyboardMonitor, c *Client) error {
+	// Compile
+	info := c.ProjectInfo()
+	compileCmd := info.BuildCommand()
+	compileCmd.Stdout = km.Stdout()
+	compileCmd.Stderr = km.Stderr()
+	if err := compileCmd.Run(); err != nil {
+		return errors.New("compilation failed")
+	}
+	_, err := flashWithRetries(ctx, c, info.AppBin, *otaRetriesArg)
+	return err
+}
+
+// promptConfig retrieves the configuration from the host, asks
+// the user for the new one and sends it to the host
+func promptConfig(ctx context.Context, km *keyboardMonitor, c *Client) error {
+	getCtx, cancel := context.WithTimeout(ctx, configTimeout)
+	cfg, err := c.GetConfig(getCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("error getting config: %v", err)
+	}
+	// Otherwise the keyboard monitor would take the
+	// answers as commands
+	km.Pause()
+	c.PromptUser("Select Wi-Fi mode [(A)uto/(s)tation/(h)ost]: ", func(s string) bool {
+		switch s {
+		case "", "a", "A":
+			cfg.WifiMode = WifiModeAuto
+		case "S", "s":
+			cfg.WifiMode = WifiModeSTA
+		case "h", "H":
+			cfg.WifiMode = WifiModeAP
+		default:
+			return false
+		}
+		return true
+	})
+	c.PromptUser("Enter Wi-Fi SSID: ", func(s string) bool {
+		cfg.WifiSSID = s
+		return true
+	})
+	c.PromptUser("Enter Wi-Fi Password: ", func(s string) bool {
+		cfg.WifiPassword = s
+		return true
+	})
+	km.Resume()
+	setCtx, cancel := context.WithTimeout(ctx, configTimeout)
+	defer cancel()
+	if err := c.SetConfig(setCtx, cfg); err != nil {
+		return fmt.Errorf("error setting config: %v", err)
+	}
+	return nil
+}
+
+// runMonitor implements the monitor command, which shows the output from
+// the host and accepts single key commands from the keyboard. With -all,
+// it monitors all the matching hosts at the same time. With -watch, the
+// app is rebuilt and flashed whenever the project changes.
+func runMonitor(fs *flag.FlagSet, args []string) error {
+	all := fs.Bool("all", false, "Monitor all the hosts matching -host at the same time, prefixing their output with the host name")
+	watch := fs.Bool("watch", false, "Rebuild the app and flash it whenever a file in the project changes")
+	watchIgnore := fs.String("watch-ignore", "", "Comma separated patterns of files to ignore in watch mode, in addition to the build directory and hidden files")
+	watchDebounce := fs.Duration("watch-debounce", time.Second, "Time without further changes to wait for before rebuilding in watch mode")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		return usageErrorf("monitor takes no arguments")
+	}
+
+	info, err := findProjectInfo(projectPath())
+	if err != nil {
+		return err
+	}
+	policy, err := ParseAddressPolicy(*preferArg)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	inv, err := loadInventory()
+	if err != nil {
+		return err
+	}
+	host, err := directHost(policy)
+	if err != nil {
+		return err
+	}
+	if host != nil && *all {
+		return usageErrorf("-all can't be used with -addr")
+	}
+	reconnect, err := reconnectPolicy()
+	if err != nil {
+		return err
+	}
+
+	// Stops watching the project when the monitor ends
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	km := &keyboardMonitor{}
+	inputCh := make(chan byte, 1)
+
+	var stdin io.Reader = os.Stdin
+	var stdout io.Writer = os.Stdout
+	var stderr io.Writer = os.Stderr
+
+	if !*nonInteractiveArg {
+		if err := km.Open(); err != nil {
+			return err
+		}
+		defer km.Close()
+		go handleInput(km, inputCh)
+		stdin = km.Stdin()
+		stdout = km.Stdout()
+		stderr = km.Stderr()
+	}
+
+	if *all {
+		m := &multiMonitor{
+			info:      info,
+			filter:    *hostArg,
+			policy:    policy,
+			reconnect: reconnect,
+			inv:       inv,
+			color:     !*nonInteractiveArg,
+			km:        km,
+			stdin:     stdin,
+			stdout:    stdout,
+			stderr:    stderr,
+		}
+		if *watch {
+			if err := startWatching(ctx, info, *watchIgnore, *watchDebounce, stdout, m.requestFlash); err != nil {
+				return err
+			}
+		}
+		return m.run(inputCh)
+	}
+
+	c, err := newClient(info, stdin, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	sess := newSession(c, km, host, *hostArg, policy, inv, !*nonInteractiveArg, reconnect)
+	if *watch {
+		if err := startWatching(ctx, info, *watchIgnore, *watchDebounce, stdout, sess.requestFlash); err != nil {
+			return err
+		}
+	}
+	return sess.run(ctx, inputCh)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// multiMonitorRescanInterval is the time between scans for new hosts
+const multiMonitorRescanInterval = 5 * time.Second
+
+// hostColors are the ANSI colors used for the host prefixes
+var hostColors = []int{32, 33, 34, 35, 36, 92, 93, 94, 95, 96}
+
+// prefixWriter prefixes each line written to it. Partial lines are
+// buffered until they're complete, so lines from several writers
+// sharing the same mutex are never mixed. Carriage returns also end
+// a line, to support progress indicators.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+	// lastCR is true when the last line written ended with \r,
+	// in case it's followed by \n in the next write
+	lastCR bool
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	var out []byte
+	for len(w.buf) > 0 {
+		if w.lastCR && w.buf[0] == '\n' {
+			out = append(out, '\n')
+			w.buf = w.buf[1:]
+			w.lastCR = false
+			continue
+		}
+		idx := bytes.IndexAny(w.buf, "\r\n")
+		if idx < 0 {
+			break
+		}
+		end := idx + 1
+		if w.buf[idx] == '\r' && end < len(w.buf) && w.buf[end] == '\n' {
+			end++
+		}
+		out = append(out, w.prefix...)
+		out = append(out, w.buf[:end]...)
+		w.lastCR = w.buf[end-1] == '\r'
+		w.buf = w.buf[end:]
+	}
+	if len(out) > 0 {
+		if _, err := w.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// monitorSession is a host monitored by the multiMonitor
+type monitorSession struct {
+	// index is the number used for selecting the host, starting at 1
+	index     int
+	name      string
+	host      *Host
+	client    *Client
+	stdout    io.Writer
+	stderr    io.Writer
+	selected  bool
+	connected bool
+	// gaveUp is true when the reconnect policy gave up on the host
+	gaveUp bool
+}
+
+// multiMonitor monitors all the hosts matching the host filter at the
+// same time, prefixing their output with their names. Keyboard commands
+// apply to the selected hosts.
+type multiMonitor struct {
+	info   *ProjectInfo
+	filter string
+	policy AddressPolicy
+	// reconnect is the policy applied to each host
+	reconnect *ReconnectPolicy
+	inv       *Inventory
+	color     bool
+	km        *keyboardMonitor
+	stdin     io.Reader
+	stdout    io.Writer
+	stderr    io.Writer
+
+	// outMu serializes the lines written by the sessions
+	outMu sync.Mutex
+	// input reads the answers to the prompts from stdin,
+	// created on first use
+	input *bufio.Reader
+
+	mu          sync.Mutex
+	sessions    []*monitorSession
+	allSelected bool
+	quit        bool
+	flashing    bool
+	// pendingFlash is true when a flash was requested
+	// by the watcher while flashing
+	pendingFlash bool
+}
+
+func (m *multiMonitor) printf(format string, args ...interface{}) {
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	fmt.Fprintf(m.stdout, format, args...)
+}
+
+// hostPrefix returns the prefix for the lines from the host with the
+// given name. The index determines its color.
+func hostPrefix(name string, index int, color bool) []byte {
+	if color {
+		c := hostColors[index%len(hostColors)]
+		return []byte(fmt.Sprintf("\x1b[%dm[%s]\x1b[0m ", c, name))
+	}
+	return []byte(fmt.Sprintf("[%s] ", name))
+}
+
+// addSession adds a session for the given host, returning it so it
+// can be started. If the host is already known, its addresses are
+// updated and the session is only returned if the reconnect policy
+// gave up on it, so it's started again.
+func (m *multiMonitor) addSession(host *Host) (*monitorSession, error) {
+	name := normalizeHostName(host.Host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range m.sessions {
+		if v.name == name {
+			v.host = host
+			if v.gaveUp {
+				v.gaveUp = false
+				return v, nil
+			}
+			return nil, nil
+		}
+	}
+	s := &monitorSession{
+		index:    len(m.sessions) + 1,
+		name:     name,
+		host:     host,
+		selected: m.allSelected,
+	}
+	prefix := hostPrefix(name, s.index-1, m.color)
+	s.stdout = &prefixWriter{mu: &m.outMu, w: m.stdout, prefix: prefix}
+	s.stderr = &prefixWriter{mu: &m.outMu, w: m.stderr, prefix: prefix}
+	c, err := newClient(m.info, m.stdin, s.stdout, s.stderr)
+	if err != nil {
+		return nil, err
+	}
+	// Coredumps are retrieved without prompting the user, since
+	// several hosts might have one at the same time
+	c.IgnoreCoreDumps = true
+	c.OTAProgressStep = fleetProgressStep
+	s.client = c
+	m.sessions = append(m.sessions, s)
+	return s, nil
+}
+
+// discover looks for new hosts periodically, starting a session
+// for each one of them. Sessions the reconnect policy gave up
+// on are started again when their hosts are found again.
+func (m *multiMonitor) discover(ch chan<- error) {
+	s := NewScanner(m.filter, false, m.stdin, m.stdout, nil)
+	s.Policy = m.policy
+	s.Inventory = m.inv
+	waiting := true
+	for {
+		hosts, err := s.Hosts()
+		if err != nil {
+			// Might be a transient network error, the hosts
+			// already found keep running
+			m.printf("error scanning for hosts: %v\n", err)
+		}
+		if len(hosts) == 0 && waiting {
+			if m.filter == "" {
+				m.printf("scanning for hosts...\n")
+			} else {
+				m.printf("waiting for hosts matching %s...\n", m.filter)
+			}
+			waiting = false
+		}
+		for _, v := range hosts {
+			sess, err := m.addSession(v)
+			if err != nil {
+				ch <- err
+				return
+			}
+			if sess != nil {
+				m.printf("found host %s as [%d]\n", v.Host, sess.index)
+				go m.runSession(sess)
+			}
+		}
+		time.Sleep(multiMonitorRescanInterval)
+	}
+}
+
+func (m *multiMonitor) isQuitting() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.quit
+}
+
+func (m *multiMonitor) setConnected(s *monitorSession, connected bool) {
+	m.mu.Lock()
+	s.connected = connected
+	m.mu.Unlock()
+}
+
+// runSession keeps the session connected until the monitor quits
+// or the reconnect policy gives up
+func (m *multiMonitor) runSession(s *monitorSession) {
+	c := s.client
+	r := newReconnector(m.reconnect)
+	for !m.isQuitting() {
+		m.mu.Lock()
+		c.Host = s.host
+		m.mu.Unlock()
+		if err := c.Connect(context.Background()); err != nil {
+			fmt.Fprintf(s.stderr, "%v\n", err)
+			if !m.waitReconnect(s, r) {
+				return
+			}
+			continue
+		}
+		if attempts, downtime, ok := r.connected(); ok {
+			fmt.Fprintf(s.stdout, "reconnected to %s after %d attempts, down for %v\n", c.Host.Host, attempts, roundDuration(downtime))
+		} else {
+			fmt.Fprintf(s.stdout, "connected to %s\n", c.Host.Host)
+		}
+		m.setConnected(s, true)
+		go m.checkCoreDump(s)
+		err := c.Run(context.Background())
+		m.setConnected(s, false)
+		c.Close()
+		if m.isQuitting() {
+			break
+		}
+		fmt.Fprintf(s.stdout, "disconnected from %s: %v\n", c.Host.Host, err)
+		if !m.waitReconnect(s, r) {
+			return
+		}
+	}
+}
+
+// waitReconnect waits until it's time to reconnect the session,
+// returning false if the reconnect policy gives up
+func (m *multiMonitor) waitReconnect(s *monitorSession, r *reconnector) bool {
+	delay, err := r.next(s.name)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "%v\n", err)
+		m.mu.Lock()
+		s.gaveUp = true
+		m.mu.Unlock()
+		return false
+	}
+	fmt.Fprintf(s.stdout, "reconnecting in %v (attempt %d)...\n", roundDuration(delay), r.attempt())
+	time.Sleep(delay)
+	return true
+}
+
+// checkCoreDump retrieves the coredump from the host once the
+// handshake finishes and archives it
+func (m *multiMonitor) checkCoreDump(s *monitorSession) {
+	c := s.client
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout*2)
+	defer cancel()
+	if err := c.WaitHandshake(ctx); err != nil {
+		return
+	}
+	if c.checkSupported(protocol.CmdCoredumpRead) != nil {
+		return
+	}
+	fetchCtx, fetchCancel := context.WithTimeout(context.Background(), *timeoutArg)
+	defer fetchCancel()
+	data, _, err := c.FetchCoreDump(fetchCtx, false)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "error retrieving coredump: %v\n", err)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	fmt.Fprintf(s.stdout, "found a coredump of %v bytes\n", len(data))
+	if c.CoreDumpDir == "" {
+		fmt.Fprintf(s.stdout, "coredump archive is disabled, use coredump fetch to retrieve it\n")
+		return
+	}
+	c.archiveCoreDump(data)
+}
+
+// selected returns the selected sessions
+func (m *multiMonitor) selected() []*monitorSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []*monitorSession
+	for _, v := range m.sessions {
+		if v.selected {
+			sessions = append(sessions, v)
+		}
+	}
+	return sessions
+}
+
+func (m *multiMonitor) list() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outMu.Lock()
+	defer m.outMu.Unlock()
+	if len(m.sessions) == 0 {
+		fmt.Fprintf(m.stdout, "no hosts found yet\n")
+		return
+	}
+	for _, v := range m.sessions {
+		mark := " "
+		if v.selected {
+			mark = "*"
+		}
+		state := "disconnected"
+		if v.connected {
+			state = "connected"
+		} else if v.gaveUp {
+			state = "gave up"
+		}
+		fmt.Fprintf(m.stdout, "%s [%d]\t%s (%s)\n", mark, v.index, v.name, state)
+	}
+}
+
+// parseHostSelection parses a comma separated list of host numbers
+// or ranges (e.g. 1,3-5), returning the selected ones
+func parseHostSelection(s string, count int) (map[int]bool, error) {
+	selection := make(map[int]bool)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		first, last := v, v
+		if idx := strings.IndexByte(v, '-'); idx >= 0 {
+			first, last = v[:idx], v[idx+1:]
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid number", first)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid number", last)
+		}
+		if from < 1 || to > count || from > to {
+			return nil, fmt.Errorf("%s is out of range [%d-%d]", v, 1, count)
+		}
+		for ii := from; ii <= to; ii++ {
+			selection[ii] = true
+		}
+	}
+	if len(selection) == 0 {
+		return nil, errors.New("no hosts selected")
+	}
+	return selection, nil
+}
+
+// selectHosts asks the user for the hosts to apply the
+// commands to
+func (m *multiMonitor) selectHosts() {
+	m.mu.Lock()
+	count := len(m.sessions)
+	m.mu.Unlock()
+	if count == 0 {
+		m.printf("no hosts found yet\n")
+		return
+	}
+	// Otherwise the keyboard monitor would take the
+	// answer as commands
+	m.km.Pause()
+	m.printf("select hosts [%d-%d] (e.g. 1,3-5) or (a)ll: ", 1, count)
+	if m.input == nil {
+		m.input = bufio.NewReader(m.stdin)
+	}
+	st, _ := m.input.ReadString('\n')
+	m.km.Resume()
+	st = strings.TrimSpace(st)
+	if st == "a" || st == "A" || st == "all" {
+		m.selectAll()
+		return
+	}
+	selection, err := parseHostSelection(st, count)
+	if err != nil {
+		m.printf("invalid selection: %v\n", err)
+		return
+	}
+	m.mu.Lock()
+	m.allSelected = false
+	for _, v := range m.sessions {
+		v.selected = selection[v.index]
+	}
+	m.mu.Unlock()
+	m.list()
+}
+
+func (m *multiMonitor) selectAll() {
+	m.mu.Lock()
+	m.allSelected = true
+	for _, v := range m.sessions {
+		v.selected = true
+	}
+	m.mu.Unlock()
+	m.printf("all hosts selected\n")
+}
+
+func (m *multiMonitor) reboot() {
+	for _, v := range m.selected() {
+		if err := v.client.Reboot(context.Background()); err != nil {
+			fmt.Fprintf(v.stderr, "error rebooting host: %v\n", err)
+		}
+	}
+}
+
+// startFlash starts flashing the selected hosts in the background,
+// unless a flash is already running. In that case, it returns false
+// and if pending is true, flashes again once the current one finishes.
+func (m *multiMonitor) startFlash(pending bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.flashing {
+		m.pendingFlash = m.pendingFlash || pending
+		return false
+	}
+	m.flashing = true
+	go func() {
+		for {
+			m.flash()
+			m.mu.Lock()
+			if !m.pendingFlash {
+				m.flashing = false
+				m.mu.Unlock()
+				return
+			}
+			m.pendingFlash = false
+			m.mu.Unlock()
+		}
+	}()
+	return true
+}
+
+// requestFlash asks the monitor to rebuild and flash the app once
+// the current flash, if any, finishes. It never blocks.
+func (m *multiMonitor) requestFlash() {
+	m.startFlash(true)
+}
+
+// flash builds the app once and flashes it to all the
+// selected hosts in parallel. Use startFlash, so only one
+// flash runs at a time.
+func (m *multiMonitor) flash() {
+	sessions := m.selected()
+	if len(sessions) == 0 {
+		m.printf("no hosts selected\n")
+		return
+	}
+	m.printf("flashing %s to %d hosts...\n", filepath.Base(m.info.AppBin), len(sessions))
+	compileCmd := m.info.BuildCommand()
+	compileCmd.Stdout = m.stdout
+	compileCmd.Stderr = m.stderr
+	if err := compileCmd.Run(); err != nil {
+		m.printf("error flashing: compilation failed\n")
+		return
+	}
+	targets := make([]*flashTarget, len(sessions))
+	for ii, v := range sessions {
+		targets[ii] = &flashTarget{name: v.name, client: v.client}
+	}
+	results := flashHosts(context.Background(), targets, m.info.AppBin, *otaConcurrencyArg, *otaRetriesArg, nil)
+	m.outMu.Lock()
+	printFlashSummary(m.stdout, results)
+	m.outMu.Unlock()
+}
+
+func (m *multiMonitor) configure() {
+	sessions := m.selected()
+	if len(sessions) != 1 {
+		m.printf("select a single host to change its configuration\n")
+		return
+	}
+	s := sessions[0]
+	if err := promptConfig(context.Background(), m.km, s.client); err != nil {
+		fmt.Fprintf(s.stderr, "%v\n", err)
+	}
+}
+
+func (m *multiMonitor) close() {
+	m.mu.Lock()
+	m.quit = true
+	sessions := m.sessions
+	m.mu.Unlock()
+	for _, v := range sessions {
+		v.client.Close()
+	}
+}
+
+// run starts monitoring the hosts, processing the keys received on
+// inputCh until the user quits
+func (m *multiMonitor) run(inputCh <-chan byte) error {
+	m.allSelected = true
+	errCh := make(chan error, 1)
+	go m.discover(errCh)
+	if !*nonInteractiveArg {
+		m.printf("press s to select hosts, a to select all, l to list them, r to reboot, f to flash, c to configure and q to quit\n")
+	}
+	for {
+		select {
+		case input := <-inputCh:
+			switch input {
+			case kmSigInt:
+				m.km.Close()
+				syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+			case 's':
+				m.selectHosts()
+			case 'a':
+				m.selectAll()
+			case 'l':
+				m.list()
+			case 'c':
+				// Waiting for the configuration and the user
+				// input blocks, handle it in a goroutine
+				go m.configure()
+			case 'f':
+				// Flashing blocks in order to ratelimit, so
+				// it runs in the background
+				if !m.startFlash(false) {
+					m.printf("already flashing, please wait\n")
+				}
+			case 'r':
+				m.reboot()
+			case 'q':
+				m.close()
+				return nil
+			}
+		case err := <-errCh:
+			m.close()
+			return err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHostSelection(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []int
+		err  string
+	}{
+		{s: "1", want: []int{1}},
+		{s: "1,3-5", want: []int{1, 3, 4, 5}},
+		{s: " 2 , 4 - 5 ,", want: []int{2, 4, 5}},
+		{s: "3-3,3", want: []int{3}},
+		{s: "", err: "no hosts selected"},
+		{s: ",", err: "no hosts selected"},
+		{s: "x", err: "not a valid number"},
+		{s: "1-x", err: "not a valid number"},
+		{s: "0", err: "out of range"},
+		{s: "6", err: "out of range"},
+		{s: "4-2", err: "out of range"},
+		{s: "4-6", err: "out of range"},
+	}
+	for _, tt := range tests {
+		selection, err := parseHostSelection(tt.s, 5)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseHostSelection(%q) = %v, %v, want an error containing %q", tt.s, selection, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHostSelection(%q) = %v", tt.s, err)
+			continue
+		}
+		var got []int
+		for ii := 1; ii <= 5; ii++ {
+			if selection[ii] {
+				got = append(got, ii)
+			}
+		}
+		if len(selection) != len(got) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseHostSelection(%q) = %v, want %v", tt.s, selection, tt.want)
+		}
+	}
+}
+
+func newTestMultiMonitor(stdin string) *multiMonitor {
+	return &multiMonitor{
+		info:   &ProjectInfo{},
+		km:     &keyboardMonitor{},
+		stdin:  strings.NewReader(stdin),
+		stdout: ioutil.Discard,
+		stderr: ioutil.Discard,
+	}
+}
+
+func TestMultiMonitorAddSession(t *testing.T) {
+	m := newTestMultiMonitor("")
+	s, err := m.addSession(&Host{Host: "dev-1.local.", Addrs: []string{"10.0.0.1:8888"}})
+	if err != nil || s == nil {
+		t.Fatalf("addSession() = %v, %v, want a new session", s, err)
+	}
+	if s.index != 1 || s.name != "dev-1" {
+		t.Errorf("session is [%d] %s, want [1] dev-1", s.index, s.name)
+	}
+	if s2, _ := m.addSession(&Host{Host: "dev-2", Addrs: []string{"10.0.0.2:8888"}}); s2 == nil || s2.index != 2 {
+		t.Errorf("second session = %+v, want index 2", s2)
+	}
+
+	// Known hosts are only updated
+	moved := &Host{Host: "DEV-1", Addrs: []string{"10.0.0.3:8888"}}
+	if again, _ := m.addSession(moved); again != nil {
+		t.Errorf("addSession() with a known host = %+v, want nil", again)
+	}
+	if s.host != moved {
+		t.Errorf("session host = %+v, want %+v", s.host, moved)
+	}
+
+	// Unless the reconnect policy gave up on them
+	s.gaveUp = true
+	if again, _ := m.addSession(moved); again != s {
+		t.Errorf("addSession() after giving up = %+v, want the same session", again)
+	}
+	if s.gaveUp {
+		t.Error("restarted session still marked as given up")
+	}
+	if len(m.sessions) != 2 {
+		t.Errorf("monitor has %d sessions, want 2", len(m.sessions))
+	}
+}
+
+func TestMultiMonitorSelectHosts(t *testing.T) {
+	m := newTestMultiMonitor("2\n1-2\nx\n")
+	for _, v := range []string{"a", "b"} {
+		if _, err := m.addSession(&Host{Host: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	selected := func() []string {
+		var names []string
+		for _, v := range m.selected() {
+			names = append(names, v.name)
+		}
+		return names
+	}
+	// Each selection must read a single line
+	for _, want := range [][]string{{"b"}, {"a", "b"}, {"a", "b"}} {
+		m.selectHosts()
+		if got := selected(); !reflect.DeepEqual(got, want) {
+			t.Errorf("selected hosts = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMultiMonitorFlashGuard(t *testing.T) {
+	m := newTestMultiMonitor("")
+	m.flashing = true
+	if m.startFlash(false) {
+		t.Error("startFlash() started a second flash")
+	}
+	if m.pendingFlash {
+		t.Error("flash from the keyboard was queued")
+	}
+	m.requestFlash()
+	if !m.pendingFlash {
+		t.Error("flash requested while flashing was not queued")
+	}
+}
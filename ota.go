@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+const (
+	// otaResumeTimeout is the maximum time we wait for the
+	// host to reconnect when a chunked OTA is interrupted
+	otaResumeTimeout = 2 * time.Minute
+	// legacyOTARate is the rate used for hosts which don't support
+	// chunked transfers, since sending faster than this might
+	// make the ESP32 drop packets
+	legacyOTARate = 100 * 1024
+	// Bounds for the number of bytes sent but not yet committed
+	// by the host during a chunked transfer
+	otaMinWindow     = protocol.OTAChunkSize
+	otaInitialWindow = 4 * protocol.OTAChunkSize
+	otaMaxWindow     = 64 * protocol.OTAChunkSize
+	// otaAckTimeout is the time we wait for the host to commit a
+	// chunk before shrinking the window
+	otaAckTimeout = time.Second
+)
+
+var (
+	errOTAInterrupted = errors.New("OTA transfer interrupted")
+	// ErrOTAFailed is returned by Flash when the host reports that
+	// the update failed
+	ErrOTAFailed = errors.New("host reported OTA failure")
+	// ErrOTASignatureRejected is returned by Flash when the host
+	// rejects the image because it's not signed or its signature
+	// is not valid
+	ErrOTASignatureRejected = errors.New("host rejected the image signature")
+)
+
+// OTADigestMismatchError is returned by Flash when the digest of the
+// image received by the host doesn't match the one we sent
+type OTADigestMismatchError struct {
+	Sent     [sha256.Size]byte
+	Received [sha256.Size]byte
+}
+
+func (e *OTADigestMismatchError) Error() string {
+	return fmt.Sprintf("OTA digest mismatch: sent image with SHA-256 %x, host computed %x", e.Sent, e.Received)
+}
+
+// otaTransfer holds the state of an OTA update
+type otaTransfer struct {
+	data   []byte
+	digest [sha256.Size]byte
+	// verified is true when the digest was sent to the host
+	verified bool
+	// chunked is true when the image is sent in chunks, which
+	// allows resuming the transfer after reconnecting
+	chunked bool
+	// compressed is true when chunks are sent compressed
+	compressed bool
+	// signature of the digest, nil when the image is not signed
+	signature []byte
+	// sent is the number of bytes sent to the host, including
+	// frame headers
+	sent int
+	// connGen is the connection generation used to send the chunks
+	connGen  int
+	progress chan uint32
+	result   chan error
+	// err and reported are only used by Client.Run(). reported
+	// is the last percentage printed, when Client.OTAProgressStep
+	// is set.
+	err      error
+	reported int
+
+	// mu guards the fields updated by both Client.Run()
+	// and Client.Flash()
+	mu          sync.Mutex
+	lastMessage time.Time
+	// committed is the last offset reported by the host
+	committed uint32
+	// Used to measure the throughput
+	startTime   time.Time
+	startOffset uint32
+}
+
+func (t *otaTransfer) size() int {
+	return len(t.data)
+}
+
+// percentage returns the percentage of the image up to offset
+func (t *otaTransfer) percentage(offset uint32) int {
+	if t.size() == 0 {
+		return 100
+	}
+	return int(offset) * 100 / t.size()
+}
+
+// touch records that the host made progress with the transfer
+func (t *otaTransfer) touch() {
+	t.mu.Lock()
+	t.lastMessage = time.Now()
+	t.mu.Unlock()
+}
+
+// idle returns the time since the host last made progress
+func (t *otaTransfer) idle() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.lastMessage)
+}
+
+func (t *otaTransfer) commit(offset uint32) {
+	t.mu.Lock()
+	t.lastMessage = time.Now()
+	t.committed = offset
+	t.mu.Unlock()
+}
+
+func (t *otaTransfer) committedOffset() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.committed
+}
+
+// start starts measuring the throughput from the given offset
+func (t *otaTransfer) start(offset uint32) {
+	t.mu.Lock()
+	t.startTime = time.Now()
+	t.startOffset = offset
+	t.mu.Unlock()
+}
+
+// elapsed returns the time since the throughput started
+// being measured
+func (t *otaTransfer) elapsed() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.startTime)
+}
+
+// throughput returns the measured upload rate in bytes per second
+func (t *otaTransfer) throughput() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := time.Since(t.startTime).Seconds()
+	if elapsed <= 0 || t.committed < t.startOffset {
+		return 0
+	}
+	return float64(t.committed-t.startOffset) / elapsed
+}
+
+// currentOTA returns the transfer in progress, if any
+func (c *Client) currentOTA() *otaTransfer {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.ota
+}
+
+func (c *Client) setOTA(t *otaTransfer) {
+	c.stateMu.Lock()
+	c.ota = t
+	c.stateMu.Unlock()
+}
+
+// clearOTA removes t from the client, unless it was
+// already replaced by another transfer
+func (c *Client) clearOTA(t *otaTransfer) {
+	c.stateMu.Lock()
+	if c.ota == t {
+		c.ota = nil
+	}
+	c.stateMu.Unlock()
+}
+
+func (c *Client) isFlashingOTA() bool {
+	t := c.currentOTA()
+	return t != nil && t.idle() < otaTimeout
+}
+
+func (c *Client) otaProgress(t *otaTransfer, offset uint32) {
+	t.commit(offset)
+	c.emit(&OTAProgress{Host: c.hostName(), Offset: int(offset), Size: t.size(), Throughput: t.throughput()})
+	// Only the latest offset matters, replace any
+	// pending one
+	select {
+	case <-t.progress:
+	default:
+	}
+	t.progress <- offset
+	percentage := t.percentage(offset)
+	if step := c.OTAProgressStep; step > 0 {
+		if t.reported >= 0 && percentage/step == t.reported/step {
+			return
+		}
+		t.reported = percentage
+		fmt.Fprintf(c.stdout, "OTA progress (%v/%v) (%d%%) %.1f KiB/s\n", offset, t.size(), percentage, t.throughput()/1024)
+		return
+	}
+	fmt.Fprintf(c.stdout, "OTA progress (%v/%v) (%d%%) %.1f KiB/s\r", offset, t.size(), percentage, t.throughput()/1024)
+}
+
+func (c *Client) checkOTADigest(t *otaTransfer, digest [sha256.Size]byte) {
+	t.touch()
+	if !t.verified {
+		return
+	}
+	if digest != t.digest {
+		t.err = &OTADigestMismatchError{Sent: t.digest, Received: digest}
+	}
+}
+
+func (c *Client) rejectOTASignature(t *otaTransfer) {
+	t.touch()
+	t.err = ErrOTASignatureRejected
+}
+
+// sendOTASignature sends the image signature, if any. It must be
+// sent right before the image.
+func (c *Client) sendOTASignature(t *otaTransfer) error {
+	if t.signature == nil {
+		return nil
+	}
+	f := &protocol.OTASignatureFrame{}
+	copy(f.Signature[:], t.signature)
+	return c.send(f)
+}
+
+// finishOTA is called when the host reports the result of the OTA
+// update, either success (err == nil) or failure
+func (c *Client) finishOTA(t *otaTransfer, err error) {
+	if t.err != nil {
+		// Either the host failed due to the digest mismatch or it
+		// claims success, but the image it received was not the one
+		// we sent. Report the mismatch in both cases.
+		err = t.err
+	}
+	if err != nil {
+		fmt.Fprintf(c.stderr, "OTA failed: %v\n", err)
+	} else {
+		fmt.Fprintf(c.stdout, "OTA finished\n")
+	}
+	// Deliver the result before clearing the transfer, so Flash()
+	// always finds it once isFlashingOTA() returns false
+	select {
+	case t.result <- err:
+	default:
+	}
+	c.clearOTA(t)
+}
+
+// Flash sends the application image read from r to the host and waits
+// until the host reports the result of the update. If the host supports
+// it, the integrity of the image is verified using its SHA-256 digest
+// and the image is sent in chunks, so the transfer can be resumed if
+// the connection is lost. If ctx is done before the update finishes,
+// the transfer is abandoned and ctx.Err() is returned.
+func (c *Client) Flash(ctx context.Context, r io.Reader) error {
+	info := c.DeviceInfo()
+	if err := c.checkInfoSupports(info, protocol.CmdOTA); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("image is empty")
+	}
+	t := &otaTransfer{
+		data:        data,
+		digest:      sha256.Sum256(data),
+		verified:    info.Supports(protocol.CmdOTAVerified),
+		chunked:     info.Supports(protocol.CmdOTABegin) && info.Supports(protocol.CmdOTAChunk),
+		lastMessage: time.Now(),
+		startTime:   time.Now(),
+		progress:    make(chan uint32, 1),
+		result:      make(chan error, 1),
+		reported:    -1,
+	}
+	if t.chunked {
+		// Chunked transfers are always verified
+		t.verified = true
+		t.compressed = c.CompressOTA && info.Supports(protocol.CmdOTAChunkFlate)
+	}
+	if !t.verified {
+		fmt.Fprintf(c.stdout, "host %s does not support verified OTA, image integrity won't be checked\n", c.hostName())
+	}
+	if c.SigningKey != nil {
+		if info.Supports(protocol.CmdOTASignature) {
+			t.signature = ed25519.Sign(c.SigningKey, t.digest[:])
+		} else {
+			fmt.Fprintf(c.stdout, "host %s does not support signed OTA, sending unsigned image\n", c.hostName())
+		}
+	}
+	c.setOTA(t)
+	err = c.sendOTA(ctx, t)
+	c.emit(&OTAResult{Host: c.hostName(), Size: t.size(), Err: err})
+	return err
+}
+
+// sendOTA sends the image and waits for the result of the update
+func (c *Client) sendOTA(ctx context.Context, t *otaTransfer) error {
+	if !t.chunked {
+		var frame protocol.Frame
+		if t.verified {
+			frame = &protocol.OTAVerifiedFrame{Digest: t.digest, Data: t.data}
+		} else {
+			frame = &protocol.OTAFrame{Data: t.data}
+		}
+		rate := c.MaxOTARate
+		if rate <= 0 || rate > legacyOTARate {
+			rate = legacyOTARate
+		}
+		var buf bytes.Buffer
+		if err := protocol.Encode(&buf, frame); err != nil {
+			c.clearOTA(t)
+			return err
+		}
+		if err := c.sendOTASignature(t); err != nil {
+			c.clearOTA(t)
+			return err
+		}
+		if err := c.writeRate(ctx, buf.Bytes(), rate); err != nil {
+			c.clearOTA(t)
+			return err
+		}
+		// Sending might take a while due to rate limiting, start
+		// counting the timeout from the end of the transfer
+		t.touch()
+		return c.waitOTA(ctx, t)
+	}
+	for {
+		err := c.sendOTAChunks(ctx, t)
+		if err == nil {
+			err = c.waitOTA(ctx, t)
+		}
+		if err == nil && t.compressed && t.size() > 0 {
+			fmt.Fprintf(c.stdout, "sent %d bytes for a %d bytes image (%.0f%%)\n",
+				t.sent, t.size(), float64(t.sent)*100/float64(t.size()))
+		}
+		if err != errOTAInterrupted {
+			if err != nil {
+				c.clearOTA(t)
+			}
+			return err
+		}
+		fmt.Fprintf(c.stdout, "OTA interrupted at %d/%d bytes, waiting for %s to reconnect...\n", t.committedOffset(), t.size(), c.hostName())
+		if err := c.waitReconnect(ctx, t.connGen, otaResumeTimeout); err != nil {
+			c.clearOTA(t)
+			return err
+		}
+	}
+}
+
+// waitOTA waits until the host reports the result of the transfer. It
+// returns errOTAInterrupted if the host stops reporting progress in the
+// middle of a chunked transfer.
+func (c *Client) waitOTA(ctx context.Context, t *otaTransfer) error {
+	for {
+		select {
+		case err := <-t.result:
+			return err
+		case <-ctx.Done():
+			c.clearOTA(t)
+			return ctx.Err()
+		case <-time.After(time.Second):
+			if t.idle() >= otaTimeout {
+				select {
+				case err := <-t.result:
+					return err
+				default:
+				}
+				if t.chunked {
+					return errOTAInterrupted
+				}
+				c.clearOTA(t)
+				return errors.New("timed out waiting for OTA result")
+			}
+		}
+	}
+}
+
+// waitReconnect waits until the connection with the host is
+// reestablished after the connection with the given generation
+// was lost and the handshake has finished
+func (c *Client) waitReconnect(ctx context.Context, gen int, timeout time.Duration) error {
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := c.waitFor(wctx, func() bool { return c.connGen != gen && c.deviceInfo != nil })
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%v: host did not reconnect in %v", errOTAInterrupted, timeout)
+	}
+	return err
+}
+
+// sendOTAChunks asks the host for the offset to start from and sends the
+// rest of the image in chunks. The number of bytes in flight is limited by
+// a window which grows while the host keeps up and shrinks when it stops
+// committing chunks. Any error while sending is reported as
+// errOTAInterrupted, since the transfer can be resumed.
+func (c *Client) sendOTAChunks(ctx context.Context, t *otaTransfer) error {
+	c.stateMu.Lock()
+	t.connGen = c.connGen
+	c.stateMu.Unlock()
+	t.touch()
+	// Drain any stale progress notification
+	select {
+	case <-t.progress:
+	default:
+	}
+	if err := c.sendOTASignature(t); err != nil {
+		return errOTAInterrupted
+	}
+	if err := c.send(&protocol.OTABeginFrame{Size: uint32(t.size()), Digest: t.digest}); err != nil {
+		return errOTAInterrupted
+	}
+	var committed uint32
+	select {
+	case committed = <-t.progress:
+	case <-time.After(otaTimeout):
+		return errOTAInterrupted
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if committed > 0 {
+		fmt.Fprintf(c.stdout, "resuming OTA at offset %d/%d\n", committed, t.size())
+	}
+	t.start(committed)
+	size := uint32(t.size())
+	offset := committed
+	window := uint32(otaInitialWindow)
+	var sent int
+	var buf bytes.Buffer
+	for committed < size {
+		for offset < size && offset-committed < window {
+			end := offset + protocol.OTAChunkSize
+			if end > size {
+				end = size
+			}
+			protocol.Encode(&buf, t.chunkFrame(offset, end))
+			offset = end
+		}
+		if buf.Len() > 0 {
+			if err := c.paceOTA(ctx, t, sent); err != nil {
+				return err
+			}
+			if err := c.write(buf.Bytes()); err != nil {
+				return errOTAInterrupted
+			}
+			sent += buf.Len()
+			t.sent += buf.Len()
+			buf.Reset()
+		}
+		select {
+		case ack := <-t.progress:
+			if ack > committed {
+				// Host is keeping up, grow the window
+				window += ack - committed
+				if window > otaMaxWindow {
+					window = otaMaxWindow
+				}
+			} else if ack < offset {
+				// Host discarded a chunk, resend from
+				// its committed offset
+				offset = ack
+			}
+			committed = ack
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(otaAckTimeout):
+			if t.idle() >= otaTimeout {
+				return errOTAInterrupted
+			}
+			window /= 2
+			if window < otaMinWindow {
+				window = otaMinWindow
+			}
+		}
+	}
+	t.touch()
+	return nil
+}
+
+// chunkFrame returns the frame for sending the image data in
+// [start, end). If compression is enabled, compressed chunks are
+// used unless they don't save any space.
+func (t *otaTransfer) chunkFrame(start uint32, end uint32) protocol.Frame {
+	data := t.data[start:end]
+	if t.compressed {
+		if f, err := protocol.NewOTAChunkFlateFrame(start, data); err == nil && len(f.Data) < len(data) {
+			return f
+		}
+	}
+	return &protocol.OTAChunkFrame{Offset: start, Data: data}
+}
+
+// paceOTA sleeps as required to keep the upload under MaxOTARate,
+// given the number of bytes already sent in the current transfer.
+// It returns ctx.Err() if ctx is done while sleeping.
+func (c *Client) paceOTA(ctx context.Context, t *otaTransfer, sent int) error {
+	if c.MaxOTARate <= 0 {
+		return nil
+	}
+	expected := time.Duration(sent) * time.Second / time.Duration(c.MaxOTARate)
+	if d := expected - t.elapsed(); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
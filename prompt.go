@@ -7,6 +7,12 @@ import (
 )
 
 func (c *Client) PromptUser(prompt string, isValid func(string) bool) string {
+	if r, ok := c.Stdin().(*keyboardMonitorReader); ok {
+		// Keep the keyboard monitor from taking the
+		// answer as commands
+		r.km.Pause()
+		defer r.km.Resume()
+	}
 	for {
 		fmt.Fprintf(c.Stdout(), prompt)
 		r := bufio.NewReader(c.Stdin())
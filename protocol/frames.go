@@ -0,0 +1,613 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// PrintFrame contains output printed by the device to either its stdout
+// or its stderr.
+type PrintFrame struct {
+	Stderr bool
+	Data   []byte
+}
+
+func (f *PrintFrame) Cmd() byte {
+	if f.Stderr {
+		return CmdPrintStderr
+	}
+	return CmdPrintStdout
+}
+
+func (f *PrintFrame) encode(w io.Writer) error {
+	return writeBlob32(w, f.Data)
+}
+
+func (f *PrintFrame) decode(r io.Reader) error {
+	data, err := readBlob32(r)
+	if err != nil {
+		return err
+	}
+	f.Data = data
+	return nil
+}
+
+// PongFrame is sent by the device in response to a PingFrame
+type PongFrame struct{}
+
+func (f *PongFrame) Cmd() byte                { return CmdPong }
+func (f *PongFrame) encode(w io.Writer) error { return nil }
+
+// OTAProgressFrame is sent periodically by the device while receiving
+// an OTA update, with the number of bytes it has written so far.
+type OTAProgressFrame struct {
+	Offset uint32
+}
+
+func (f *OTAProgressFrame) Cmd() byte { return CmdOTAProgress }
+
+func (f *OTAProgressFrame) encode(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, f.Offset)
+}
+
+func (f *OTAProgressFrame) decode(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, &f.Offset)
+}
+
+// OTASuccessFrame is sent by the device after an OTA update has been
+// successfully written.
+type OTASuccessFrame struct{}
+
+func (f *OTASuccessFrame) Cmd() byte                { return CmdOTASuccess }
+func (f *OTASuccessFrame) encode(w io.Writer) error { return nil }
+
+// OTAFailedFrame is sent by the device when an OTA update couldn't
+// be written.
+type OTAFailedFrame struct{}
+
+func (f *OTAFailedFrame) Cmd() byte                { return CmdOTAFailed }
+func (f *OTAFailedFrame) encode(w io.Writer) error { return nil }
+
+// ConfigFrame is sent by the device in response to either a GetConfigFrame
+// or a SetConfigFrame. Config is nil when the device has no stored
+// configuration.
+type ConfigFrame struct {
+	Config *Config
+}
+
+func (f *ConfigFrame) Cmd() byte { return CmdConfig }
+
+func (f *ConfigFrame) encode(w io.Writer) error {
+	return writeConfig(w, f.Config)
+}
+
+func (f *ConfigFrame) decode(r io.Reader) error {
+	cfg, err := readConfig(r)
+	if err != nil {
+		return err
+	}
+	f.Config = cfg
+	return nil
+}
+
+// ContinueFrame is sent by the client to let the device continue booting
+// after checking for a coredump, and by the device to notify the client
+// that it has continued.
+type ContinueFrame struct{}
+
+func (f *ContinueFrame) Cmd() byte                { return CmdContinue }
+func (f *ContinueFrame) encode(w io.Writer) error { return nil }
+
+// CoredumpFrame is sent by the device in response to a CoredumpReadFrame.
+// Data is empty when the device has no stored coredump.
+type CoredumpFrame struct {
+	Data []byte
+}
+
+func (f *CoredumpFrame) Cmd() byte { return CmdCoredumpRead }
+
+func (f *CoredumpFrame) encode(w io.Writer) error {
+	return writeBlob32(w, f.Data)
+}
+
+func (f *CoredumpFrame) decode(r io.Reader) error {
+	data, err := readBlob32(r)
+	if err != nil {
+		return err
+	}
+	f.Data = data
+	return nil
+}
+
+// CoredumpEraseFrame is sent by the client to erase the stored coredump,
+// and echoed back by the device once it has been erased.
+type CoredumpEraseFrame struct{}
+
+func (f *CoredumpEraseFrame) Cmd() byte                { return CmdCoredumpErase }
+func (f *CoredumpEraseFrame) encode(w io.Writer) error { return nil }
+
+// PingFrame is sent by the client to check if the device is still alive
+type PingFrame struct{}
+
+func (f *PingFrame) Cmd() byte                { return CmdPing }
+func (f *PingFrame) encode(w io.Writer) error { return nil }
+
+// RebootFrame is sent by the client to reboot the device
+type RebootFrame struct{}
+
+func (f *RebootFrame) Cmd() byte                { return CmdReboot }
+func (f *RebootFrame) encode(w io.Writer) error { return nil }
+
+// OTAFrame is sent by the client with a new application image
+type OTAFrame struct {
+	Data []byte
+}
+
+func (f *OTAFrame) Cmd() byte { return CmdOTA }
+
+func (f *OTAFrame) encode(w io.Writer) error {
+	return writeBlob32(w, f.Data)
+}
+
+func (f *OTAFrame) decode(r io.Reader) error {
+	data, err := readBlob32(r)
+	if err != nil {
+		return err
+	}
+	f.Data = data
+	return nil
+}
+
+// OTAVerifiedFrame is sent by the client with a new application image and
+// its SHA-256 digest. The device must reply with an OTADigestFrame once the
+// image has been received.
+type OTAVerifiedFrame struct {
+	Digest [sha256.Size]byte
+	Data   []byte
+}
+
+func (f *OTAVerifiedFrame) Cmd() byte { return CmdOTAVerified }
+
+func (f *OTAVerifiedFrame) encode(w io.Writer) error {
+	if _, err := w.Write(f.Digest[:]); err != nil {
+		return err
+	}
+	return writeBlob32(w, f.Data)
+}
+
+func (f *OTAVerifiedFrame) decode(r io.Reader) error {
+	if _, err := io.ReadFull(r, f.Digest[:]); err != nil {
+		return err
+	}
+	data, err := readBlob32(r)
+	if err != nil {
+		return err
+	}
+	f.Data = data
+	return nil
+}
+
+// OTADigestFrame is sent by the device after receiving the image from an
+// OTAVerifiedFrame, with the SHA-256 digest of the received data. It's
+// always followed by either an OTASuccessFrame or an OTAFailedFrame.
+type OTADigestFrame struct {
+	Digest [sha256.Size]byte
+}
+
+func (f *OTADigestFrame) Cmd() byte { return CmdOTADigest }
+
+func (f *OTADigestFrame) encode(w io.Writer) error {
+	_, err := w.Write(f.Digest[:])
+	return err
+}
+
+func (f *OTADigestFrame) decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.Digest[:])
+	return err
+}
+
+// OTABeginFrame is sent by the client to start or resume a chunked OTA
+// update. The device replies with an OTAProgressFrame containing the
+// offset of the first chunk it expects.
+type OTABeginFrame struct {
+	Size   uint32
+	Digest [sha256.Size]byte
+}
+
+func (f *OTABeginFrame) Cmd() byte { return CmdOTABegin }
+
+func (f *OTABeginFrame) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.Size); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Digest[:])
+	return err
+}
+
+func (f *OTABeginFrame) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.Size); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, f.Digest[:])
+	return err
+}
+
+// OTAChunkFrame is sent by the client with a chunk of the image being
+// transferred, starting at Offset. Data must not be longer than
+// OTAChunkSize.
+type OTAChunkFrame struct {
+	Offset uint32
+	Data   []byte
+}
+
+func (f *OTAChunkFrame) Cmd() byte { return CmdOTAChunk }
+
+func (f *OTAChunkFrame) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.Offset); err != nil {
+		return err
+	}
+	return writeBlob16(w, f.Data)
+}
+
+func (f *OTAChunkFrame) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.Offset); err != nil {
+		return err
+	}
+	data, err := readBlob16(r)
+	if err != nil {
+		return err
+	}
+	f.Data = data
+	return nil
+}
+
+// OTAChunkFlateFrame is like OTAChunkFrame, but its data is compressed
+// with raw DEFLATE. Offset refers to the uncompressed image, and the
+// uncompressed data must not be longer than OTAChunkSize.
+type OTAChunkFlateFrame struct {
+	Offset uint32
+	Data   []byte
+}
+
+// NewOTAChunkFlateFrame compresses the given chunk, starting at offset,
+// into an OTAChunkFlateFrame
+func NewOTAChunkFlateFrame(offset uint32, data []byte) (*OTAChunkFlateFrame, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &OTAChunkFlateFrame{Offset: offset, Data: buf.Bytes()}, nil
+}
+
+// Decompress returns the uncompressed data in the chunk
+func (f *OTAChunkFlateFrame) Decompress() ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(f.Data))
+	defer r.Close()
+	// Don't allow decompression bombs
+	data, err := ioutil.ReadAll(io.LimitReader(r, OTAChunkSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > OTAChunkSize {
+		return nil, errors.New("decompressed chunk is too big")
+	}
+	return data, nil
+}
+
+func (f *OTAChunkFlateFrame) Cmd() byte { return CmdOTAChunkFlate }
+
+func (f *OTAChunkFlateFrame) encode(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, f.Offset); err != nil {
+		return err
+	}
+	return writeBlob16(w, f.Data)
+}
+
+func (f *OTAChunkFlateFrame) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.Offset); err != nil {
+		return err
+	}
+	data, err := readBlob16(r)
+	if err != nil {
+		return err
+	}
+	f.Data = data
+	return nil
+}
+
+// CoredumpReadFrame is sent by the client to retrieve the coredump
+// stored in the device, if any.
+type CoredumpReadFrame struct{}
+
+func (f *CoredumpReadFrame) Cmd() byte                { return CmdCoredumpRead }
+func (f *CoredumpReadFrame) encode(w io.Writer) error { return nil }
+
+// GetConfigFrame is sent by the client to retrieve the device configuration
+type GetConfigFrame struct{}
+
+func (f *GetConfigFrame) Cmd() byte                { return CmdGetConfig }
+func (f *GetConfigFrame) encode(w io.Writer) error { return nil }
+
+// SetConfigFrame is sent by the client to store a new device configuration
+type SetConfigFrame struct {
+	Config *Config
+}
+
+func (f *SetConfigFrame) Cmd() byte { return CmdSetConfig }
+
+func (f *SetConfigFrame) encode(w io.Writer) error {
+	return writeConfig(w, f.Config)
+}
+
+func (f *SetConfigFrame) decode(r io.Reader) error {
+	cfg, err := readConfig(r)
+	if err != nil {
+		return err
+	}
+	f.Config = cfg
+	return nil
+}
+
+// HelloFrame is sent by the client right after connecting, to request
+// an InfoFrame from the device.
+type HelloFrame struct{}
+
+func (f *HelloFrame) Cmd() byte                { return CmdHello }
+func (f *HelloFrame) encode(w io.Writer) error { return nil }
+
+// InfoFrame is sent by the device in response to a HelloFrame
+type InfoFrame struct {
+	// ProtocolVersion is the version of the protocol implemented
+	// by the device
+	ProtocolVersion uint8
+	// FirmwareVersion is a free form string describing the
+	// firmware running in the device
+	FirmwareVersion string
+	// Commands contains all the commands supported by the device
+	Commands []byte
+}
+
+// LegacyInfo returns the information assumed for devices which
+// don't reply to HelloFrame.
+func LegacyInfo() *InfoFrame {
+	return &InfoFrame{
+		Commands: append([]byte(nil), legacyCommands...),
+	}
+}
+
+func (f *InfoFrame) Cmd() byte { return CmdInfo }
+
+// Supports returns true iff the device supports the given command
+func (f *InfoFrame) Supports(cmd byte) bool {
+	return bytes.IndexByte(f.Commands, cmd) >= 0
+}
+
+func (f *InfoFrame) encode(w io.Writer) error {
+	if len(f.Commands) > 0xff {
+		return errors.New("too many commands")
+	}
+	if _, err := w.Write([]byte{f.ProtocolVersion}); err != nil {
+		return err
+	}
+	if err := writeBlob16(w, []byte(f.FirmwareVersion)); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{byte(len(f.Commands))}); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Commands)
+	return err
+}
+
+func (f *InfoFrame) decode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &f.ProtocolVersion); err != nil {
+		return err
+	}
+	version, err := readBlob16(r)
+	if err != nil {
+		return err
+	}
+	f.FirmwareVersion = string(version)
+	var count uint8
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	f.Commands = make([]byte, int(count))
+	_, err = io.ReadFull(r, f.Commands)
+	return err
+}
+
+// OTASignatureFrame is sent by the client before an OTA image. Signature
+// is the Ed25519 signature of the SHA-256 digest of the image.
+type OTASignatureFrame struct {
+	Signature [ed25519.SignatureSize]byte
+}
+
+func (f *OTASignatureFrame) Cmd() byte { return CmdOTASignature }
+
+func (f *OTASignatureFrame) encode(w io.Writer) error {
+	_, err := w.Write(f.Signature[:])
+	return err
+}
+
+func (f *OTASignatureFrame) decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.Signature[:])
+	return err
+}
+
+// Verify returns true if the signature is valid for an image with the
+// given digest
+func (f *OTASignatureFrame) Verify(key ed25519.PublicKey, digest [sha256.Size]byte) bool {
+	return ed25519.Verify(key, digest[:], f.Signature[:])
+}
+
+// OTASignatureInvalidFrame is sent by the device when an OTA image
+// is rejected due to a missing or invalid signature
+type OTASignatureInvalidFrame struct{}
+
+func (f *OTASignatureInvalidFrame) Cmd() byte                { return CmdOTASignatureInvalid }
+func (f *OTASignatureInvalidFrame) encode(w io.Writer) error { return nil }
+
+// AuthNonceSize is the size of the random nonces used during
+// authentication
+const AuthNonceSize = 16
+
+// AuthInitFrame is sent by the client to start authentication
+type AuthInitFrame struct {
+	Nonce [AuthNonceSize]byte
+}
+
+func (f *AuthInitFrame) Cmd() byte { return CmdAuthInit }
+
+func (f *AuthInitFrame) encode(w io.Writer) error {
+	_, err := w.Write(f.Nonce[:])
+	return err
+}
+
+func (f *AuthInitFrame) decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.Nonce[:])
+	return err
+}
+
+// AuthChallengeFrame is sent by the device as a reply to AuthInitFrame
+type AuthChallengeFrame struct {
+	Nonce [AuthNonceSize]byte
+	MAC   [sha256.Size]byte
+}
+
+func (f *AuthChallengeFrame) Cmd() byte { return CmdAuthChallenge }
+
+func (f *AuthChallengeFrame) encode(w io.Writer) error {
+	if _, err := w.Write(f.Nonce[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.MAC[:])
+	return err
+}
+
+func (f *AuthChallengeFrame) decode(r io.Reader) error {
+	if _, err := io.ReadFull(r, f.Nonce[:]); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, f.MAC[:])
+	return err
+}
+
+// AuthProofFrame is sent by the client to finish authentication
+type AuthProofFrame struct {
+	MAC [sha256.Size]byte
+}
+
+func (f *AuthProofFrame) Cmd() byte { return CmdAuthProof }
+
+func (f *AuthProofFrame) encode(w io.Writer) error {
+	_, err := w.Write(f.MAC[:])
+	return err
+}
+
+func (f *AuthProofFrame) decode(r io.Reader) error {
+	_, err := io.ReadFull(r, f.MAC[:])
+	return err
+}
+
+// AuthRequiredFrame is sent by devices with a pre-shared key when
+// the client sends a command without authenticating first
+type AuthRequiredFrame struct{}
+
+func (f *AuthRequiredFrame) Cmd() byte                { return CmdAuthRequired }
+func (f *AuthRequiredFrame) encode(w io.Writer) error { return nil }
+
+// Config is the configuration stored in the device
+type Config struct {
+	Version      uint8
+	WifiSSID     string
+	WifiPassword string
+	WifiMode     uint8
+}
+
+const (
+	// ConfigVersion is the version of the configuration format
+	ConfigVersion = 1
+	// ConfigSSIDLen is the size of the SSID field, including the
+	// trailing NUL
+	ConfigSSIDLen = 33
+	// ConfigPasswordLen is the size of the password field
+	ConfigPasswordLen = 64
+	// configSize is the encoded size of the configuration
+	configSize = 1 + ConfigSSIDLen + ConfigPasswordLen + 1
+)
+
+// Values for Config.WifiMode
+const (
+	WifiModeAuto = iota
+	WifiModeSTA
+	WifiModeAP
+)
+
+// writePadded writes s truncated to max bytes, padded with
+// zeros up to size
+func writePadded(buf *bytes.Buffer, s string, max int, size int) {
+	data := []byte(s)
+	if len(data) > max {
+		data = data[:max]
+	}
+	buf.Write(data)
+	for ii := len(data); ii < size; ii++ {
+		buf.WriteByte(0)
+	}
+}
+
+func writeConfig(w io.Writer, cfg *Config) error {
+	var buf bytes.Buffer
+	if cfg == nil {
+		binary.Write(&buf, binary.BigEndian, uint16(0))
+	} else {
+		binary.Write(&buf, binary.BigEndian, uint16(configSize))
+		// Always send the version we know how to encode
+		buf.WriteByte(ConfigVersion)
+		// Leave room for the NUL at the end of the SSID
+		writePadded(&buf, cfg.WifiSSID, ConfigSSIDLen-1, ConfigSSIDLen)
+		writePadded(&buf, cfg.WifiPassword, ConfigPasswordLen, ConfigPasswordLen)
+		buf.WriteByte(cfg.WifiMode)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readConfig(r io.Reader) (*Config, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	data := make([]byte, int(size))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if len(data) < configSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	ssid := data[1 : 1+ConfigSSIDLen]
+	password := data[1+ConfigSSIDLen : 1+ConfigSSIDLen+ConfigPasswordLen]
+	return &Config{
+		Version:      data[0],
+		WifiSSID:     string(bytes.Trim(ssid, "\x00")),
+		WifiPassword: string(bytes.Trim(password, "\x00")),
+		WifiMode:     data[configSize-1],
+	}, nil
+}
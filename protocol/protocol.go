@@ -0,0 +1,380 @@
+// Package protocol implements the wire protocol spoken between idf_wmonitor
+// and the monitor component running on the device, which is advertised over
+// mDNS as _esp32wmonitor._tcp.
+//
+// Every frame starts with a single command byte, optionally followed by a
+// payload. All integers are encoded in big endian. Commands below 128 are
+// sent by the device, while commands starting at 128 are sent by the client.
+// A few commands (continue, coredump read and coredump erase) are used in
+// both directions, with a payload that depends on the direction, so frames
+// sent by the device must be decoded with Decode and frames sent by the
+// client with DecodeRequest.
+//
+// Right after connecting, the client sends CmdHello and the device replies
+// with CmdInfo, reporting its protocol version, firmware version and the
+// commands it supports. Devices running older firmware don't reply to
+// CmdHello, in which case the client should assume they support the
+// commands returned by LegacyInfo. Since CmdHello has no payload, older
+// firmware can safely skip it.
+//
+// OTA updates sent with CmdOTAVerified include the SHA-256 digest of the
+// image, computed by the client. While receiving the image, the device
+// sends CmdOTAProgress periodically. Once the whole image has been
+// received, the device must send CmdOTADigest with the digest it computed
+// over the bytes it received, followed by either CmdOTASuccess or
+// CmdOTAFailed. If the digests don't match, the device must discard the
+// image and reply with CmdOTAFailed.
+//
+// Devices supporting CmdOTABegin and CmdOTAChunk can receive images in
+// chunks, which allows resuming interrupted transfers. The client starts
+// with CmdOTABegin, sending the size and SHA-256 digest of the image. The
+// device replies with CmdOTAProgress, containing the offset the client
+// should start sending from: 0 for a new image, or the number of bytes
+// already committed if the device holds a partial transfer of the same
+// image (same size and digest) from a previous connection. The client then
+// sends CmdOTAChunk frames with consecutive offsets, and the device replies
+// to each one with CmdOTAProgress and the total number of committed bytes.
+// Chunks whose offset doesn't match the committed offset are discarded,
+// and the device replies with CmdOTAProgress so the client can realign.
+// Once all the bytes have been committed, the device finishes the transfer
+// like with CmdOTAVerified, sending CmdOTADigest followed by the result.
+//
+// Devices supporting CmdOTAChunkFlate also accept chunks compressed with
+// raw DEFLATE (RFC 1951). Each chunk is compressed independently, so the
+// device can decompress it without any state from previous chunks, and
+// its offset refers to the uncompressed image. Offsets reported via
+// CmdOTAProgress are always relative to the uncompressed image too. Both
+// kinds of chunks can be mixed in the same transfer.
+//
+// Devices supporting CmdOTASignature accept an Ed25519 signature of the
+// SHA-256 digest of the image, sent with CmdOTASignature right before
+// CmdOTA, CmdOTAVerified or CmdOTABegin. Devices configured with a public
+// key must reject images without a valid signature, by sending
+// CmdOTASignatureInvalid followed by CmdOTAFailed once the whole image has
+// been received. The signature is checked against the digest of the
+// received image.
+//
+// Devices configured with a pre-shared key require the client to
+// authenticate before sending any other command, including CmdHello.
+// The client sends CmdAuthInit with a random nonce, and the device
+// replies with CmdAuthChallenge, containing its own random nonce and an
+// HMAC-SHA256 over both nonces proving it knows the key. The client
+// verifies it and sends CmdAuthProof with its own HMAC. From then on, all
+// the data in both directions is encrypted with AES-256-GCM, using keys
+// derived from the pre-shared key and both nonces (see SecureConn). If
+// a device configured with a key receives any other command before
+// authenticating, it replies with CmdAuthRequired and disconnects.
+// Commands used during authentication are never listed in CmdInfo.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ServiceName is the mDNS service advertised by the devices
+const ServiceName = "_esp32wmonitor._tcp"
+
+// Keys for the TXT record fields that devices may advertise, in
+// key=value format, together with ServiceName
+const (
+	TXTFirmwareVersion = "version"
+	TXTChip            = "chip"
+	TXTApp             = "app"
+	// Uptime in seconds
+	TXTUptime = "uptime"
+)
+
+// Commands sent by the device
+const (
+	CmdPrintStdout = 0
+	CmdPrintStderr = 1
+	CmdPong        = 5
+	CmdOTAProgress = 6
+	CmdOTASuccess  = 7
+	CmdOTAFailed   = 8
+	CmdConfig      = 9
+	CmdInfo        = 10
+	CmdOTADigest   = 11
+	// Sent during authentication, see ClientHandshake
+	CmdAuthChallenge = 12
+	CmdAuthRequired  = 13
+	// Sent before CmdOTAFailed when the image signature is invalid
+	CmdOTASignatureInvalid = 14
+)
+
+// Commands sent by the client. CmdContinue, CmdCoredumpRead and
+// CmdCoredumpErase are also sent by the device.
+const (
+	CmdPing          = 128
+	CmdReboot        = 129
+	CmdOTA           = 130
+	CmdContinue      = 131
+	CmdCoredumpRead  = 132
+	CmdCoredumpErase = 133
+	CmdGetConfig     = 134
+	CmdSetConfig     = 135
+	CmdHello         = 136
+	CmdOTAVerified   = 137
+	CmdOTABegin      = 138
+	CmdOTAChunk      = 139
+	CmdOTAChunkFlate = 140
+	// Sent during authentication, see ClientHandshake
+	CmdAuthInit  = 141
+	CmdAuthProof = 142
+	// Sent before an OTA image, see OTASignatureFrame
+	CmdOTASignature = 143
+)
+
+// OTAChunkSize is the maximum size of the data in an OTAChunkFrame
+const OTAChunkSize = 4096
+
+// Version is the protocol version implemented by this package. Devices
+// running firmware which predates the handshake are considered to be
+// running version 0.
+const Version = 1
+
+var commandNames = map[byte]string{
+	CmdPing:          "ping",
+	CmdReboot:        "reboot",
+	CmdOTA:           "OTA",
+	CmdContinue:      "continue",
+	CmdCoredumpRead:  "coredump read",
+	CmdCoredumpErase: "coredump erase",
+	CmdGetConfig:     "get config",
+	CmdSetConfig:     "set config",
+	CmdHello:         "hello",
+	CmdOTAVerified:   "verified OTA",
+	CmdOTABegin:      "begin OTA",
+	CmdOTAChunk:      "OTA chunk",
+	CmdOTAChunkFlate: "compressed OTA chunk",
+	CmdAuthInit:      "authentication",
+	CmdAuthProof:     "authentication proof",
+	CmdOTASignature:  "signed OTA",
+}
+
+// CommandName returns a human readable name for a command sent
+// by the client.
+func CommandName(cmd byte) string {
+	if name := commandNames[cmd]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("command %d", cmd)
+}
+
+// legacyCommands are the commands supported by devices which
+// don't reply to CmdHello
+var legacyCommands = []byte{
+	CmdPing,
+	CmdReboot,
+	CmdOTA,
+	CmdContinue,
+	CmdCoredumpRead,
+	CmdCoredumpErase,
+	CmdGetConfig,
+	CmdSetConfig,
+}
+
+// Commands returns all the commands that can be sent by the client in
+// this version of the protocol.
+func Commands() []byte {
+	return append(append([]byte(nil), legacyCommands...), CmdHello, CmdOTAVerified, CmdOTABegin, CmdOTAChunk, CmdOTAChunkFlate, CmdOTASignature)
+}
+
+// Frame is implemented by all the messages in the protocol
+type Frame interface {
+	// Cmd returns the command byte that identifies the frame
+	Cmd() byte
+	encode(w io.Writer) error
+}
+
+// UnknownCommandError is returned when decoding a frame with an
+// unknown command byte. Since the length of the payload is not known,
+// the stream can't be reliably decoded after this error.
+type UnknownCommandError struct {
+	Cmd byte
+}
+
+func (e *UnknownCommandError) Error() string {
+	return fmt.Sprintf("unknown command %v", e.Cmd)
+}
+
+// Encode writes the given frame to w
+func Encode(w io.Writer, f Frame) error {
+	if _, err := w.Write([]byte{f.Cmd()}); err != nil {
+		return err
+	}
+	return f.encode(w)
+}
+
+func readCmd(r io.Reader) (byte, error) {
+	var cmd [1]byte
+	if _, err := io.ReadFull(r, cmd[:]); err != nil {
+		return 0, err
+	}
+	return cmd[0], nil
+}
+
+// Decode reads a frame sent by the device from r
+func Decode(r io.Reader) (Frame, error) {
+	cmd, err := readCmd(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeFrame(cmd, r)
+}
+
+// DecodeFrame decodes the payload of a frame sent by the device, after
+// its command byte has already been read from r.
+func DecodeFrame(cmd byte, r io.Reader) (Frame, error) {
+	var f Frame
+	switch cmd {
+	case CmdPrintStdout:
+		f = &PrintFrame{}
+	case CmdPrintStderr:
+		f = &PrintFrame{Stderr: true}
+	case CmdPong:
+		f = &PongFrame{}
+	case CmdOTAProgress:
+		f = &OTAProgressFrame{}
+	case CmdOTASuccess:
+		f = &OTASuccessFrame{}
+	case CmdOTAFailed:
+		f = &OTAFailedFrame{}
+	case CmdConfig:
+		f = &ConfigFrame{}
+	case CmdInfo:
+		f = &InfoFrame{}
+	case CmdOTADigest:
+		f = &OTADigestFrame{}
+	case CmdAuthChallenge:
+		f = &AuthChallengeFrame{}
+	case CmdAuthRequired:
+		f = &AuthRequiredFrame{}
+	case CmdOTASignatureInvalid:
+		f = &OTASignatureInvalidFrame{}
+	case CmdContinue:
+		f = &ContinueFrame{}
+	case CmdCoredumpRead:
+		f = &CoredumpFrame{}
+	case CmdCoredumpErase:
+		f = &CoredumpEraseFrame{}
+	default:
+		return nil, &UnknownCommandError{Cmd: cmd}
+	}
+	if err := decodePayload(f, r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// DecodeRequest reads a frame sent by the client from r
+func DecodeRequest(r io.Reader) (Frame, error) {
+	cmd, err := readCmd(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeRequestFrame(cmd, r)
+}
+
+// DecodeRequestFrame decodes the payload of a frame sent by the client,
+// after its command byte has already been read from r.
+func DecodeRequestFrame(cmd byte, r io.Reader) (Frame, error) {
+	var f Frame
+	switch cmd {
+	case CmdPing:
+		f = &PingFrame{}
+	case CmdReboot:
+		f = &RebootFrame{}
+	case CmdOTA:
+		f = &OTAFrame{}
+	case CmdContinue:
+		f = &ContinueFrame{}
+	case CmdCoredumpRead:
+		f = &CoredumpReadFrame{}
+	case CmdCoredumpErase:
+		f = &CoredumpEraseFrame{}
+	case CmdGetConfig:
+		f = &GetConfigFrame{}
+	case CmdSetConfig:
+		f = &SetConfigFrame{}
+	case CmdHello:
+		f = &HelloFrame{}
+	case CmdOTAVerified:
+		f = &OTAVerifiedFrame{}
+	case CmdOTABegin:
+		f = &OTABeginFrame{}
+	case CmdOTAChunk:
+		f = &OTAChunkFrame{}
+	case CmdOTAChunkFlate:
+		f = &OTAChunkFlateFrame{}
+	case CmdAuthInit:
+		f = &AuthInitFrame{}
+	case CmdAuthProof:
+		f = &AuthProofFrame{}
+	case CmdOTASignature:
+		f = &OTASignatureFrame{}
+	default:
+		return nil, &UnknownCommandError{Cmd: cmd}
+	}
+	if err := decodePayload(f, r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type decoder interface {
+	decode(r io.Reader) error
+}
+
+func decodePayload(f Frame, r io.Reader) error {
+	if d, ok := f.(decoder); ok {
+		return d.decode(r)
+	}
+	// No payload
+	return nil
+}
+
+func writeBlob32(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func writeBlob16(w io.Writer, data []byte) error {
+	if len(data) > 0xffff {
+		return fmt.Errorf("blob too long (%d bytes)", len(data))
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBlob16(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, int(size))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readBlob32(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	data := make([]byte, int(size))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
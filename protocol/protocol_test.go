@@ -0,0 +1,208 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testDigest(b byte) (d [32]byte) {
+	for ii := range d {
+		d[ii] = b + byte(ii)
+	}
+	return d
+}
+
+// deviceFrames contains a frame of each type sent by the device
+var deviceFrames = []Frame{
+	&PrintFrame{Data: []byte("hello\n")},
+	&PrintFrame{Stderr: true, Data: []byte("error\n")},
+	&PongFrame{},
+	&OTAProgressFrame{Offset: 123456},
+	&OTASuccessFrame{},
+	&OTAFailedFrame{},
+	&ConfigFrame{Config: &Config{Version: ConfigVersion, WifiSSID: "ssid", WifiPassword: "password", WifiMode: WifiModeAP}},
+	&ConfigFrame{},
+	&InfoFrame{ProtocolVersion: Version, FirmwareVersion: "v1.2.3", Commands: Commands()},
+	&OTADigestFrame{Digest: testDigest(1)},
+	&AuthChallengeFrame{Nonce: [AuthNonceSize]byte{1, 2, 3}, MAC: testDigest(2)},
+	&AuthRequiredFrame{},
+	&OTASignatureInvalidFrame{},
+	&ContinueFrame{},
+	&CoredumpFrame{Data: []byte{0xE5, 0xE5, 0xE5, 0xE5, 1, 2}},
+	&CoredumpEraseFrame{},
+}
+
+// clientFrames contains a frame of each type sent by the client
+var clientFrames = []Frame{
+	&PingFrame{},
+	&RebootFrame{},
+	&OTAFrame{Data: []byte("image")},
+	&ContinueFrame{},
+	&CoredumpReadFrame{},
+	&CoredumpEraseFrame{},
+	&GetConfigFrame{},
+	&SetConfigFrame{Config: &Config{Version: ConfigVersion, WifiSSID: "ssid", WifiMode: WifiModeSTA}},
+	&HelloFrame{},
+	&OTAVerifiedFrame{Digest: testDigest(3), Data: []byte("image")},
+	&OTABeginFrame{Size: 1 << 20, Digest: testDigest(4)},
+	&OTAChunkFrame{Offset: 4096, Data: []byte("chunk")},
+	&OTAChunkFlateFrame{Offset: 8192, Data: []byte{1, 2, 3}},
+	&AuthInitFrame{Nonce: [AuthNonceSize]byte{4, 5, 6}},
+	&AuthProofFrame{MAC: testDigest(5)},
+	&OTASignatureFrame{Signature: [64]byte{7, 8, 9}},
+}
+
+func testRoundTrip(t *testing.T, frames []Frame, decode func(io.Reader) (Frame, error)) {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := Encode(&buf, f); err != nil {
+			t.Fatalf("encoding %T: %v", f, err)
+		}
+	}
+	for _, f := range frames {
+		decoded, err := decode(&buf)
+		if err != nil {
+			t.Fatalf("decoding %T: %v", f, err)
+		}
+		if !reflect.DeepEqual(decoded, f) {
+			t.Errorf("decoded %#v, want %#v", decoded, f)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after decoding all the frames", buf.Len())
+	}
+}
+
+func TestDeviceFramesRoundTrip(t *testing.T) {
+	testRoundTrip(t, deviceFrames, Decode)
+}
+
+func TestClientFramesRoundTrip(t *testing.T) {
+	testRoundTrip(t, clientFrames, DecodeRequest)
+}
+
+func TestConfigTruncated(t *testing.T) {
+	tests := []struct {
+		ssid string
+		want string
+	}{
+		{"a very long SSID which doesn't fit in the field", "a very long SSID which doesn't f"},
+		// 33 bytes, one more than fits with the NUL
+		{strings.Repeat("x", ConfigSSIDLen), strings.Repeat("x", ConfigSSIDLen-1)},
+		{strings.Repeat("x", ConfigSSIDLen-1), strings.Repeat("x", ConfigSSIDLen-1)},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Version: ConfigVersion, WifiSSID: tt.ssid}
+		var buf bytes.Buffer
+		if err := writeConfig(&buf, cfg); err != nil {
+			t.Fatal(err)
+		}
+		// The SSID field must always end with a NUL
+		if data := buf.Bytes(); data[2+ConfigSSIDLen] != 0 {
+			t.Errorf("SSID %q is not NUL terminated", tt.ssid)
+		}
+		decoded, err := readConfig(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.WifiSSID != tt.want {
+			t.Errorf("SSID = %q, want %q", decoded.WifiSSID, tt.want)
+		}
+	}
+}
+
+func encodedConfig(size uint16, payload []byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, size)
+	buf.Write(payload)
+	return &buf
+}
+
+func TestReadConfig(t *testing.T) {
+	full := make([]byte, configSize)
+	full[0] = ConfigVersion
+	copy(full[1:], "ssid")
+	full[configSize-1] = WifiModeAP
+
+	t.Run("zero size", func(t *testing.T) {
+		cfg, err := readConfig(encodedConfig(0, nil))
+		if err != nil || cfg != nil {
+			t.Errorf("readConfig() = %v, %v, want nil, nil", cfg, err)
+		}
+	})
+	t.Run("short size", func(t *testing.T) {
+		if _, err := readConfig(encodedConfig(10, full[:10])); err != io.ErrUnexpectedEOF {
+			t.Errorf("readConfig() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+	t.Run("short payload", func(t *testing.T) {
+		if _, err := readConfig(encodedConfig(configSize, full[:20])); err != io.ErrUnexpectedEOF {
+			t.Errorf("readConfig() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+	t.Run("missing size", func(t *testing.T) {
+		if _, err := readConfig(bytes.NewReader([]byte{0})); err != io.ErrUnexpectedEOF {
+			t.Errorf("readConfig() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+	t.Run("longer size", func(t *testing.T) {
+		// Newer firmware might append fields, which must be skipped
+		payload := append(append([]byte(nil), full...), 1, 2, 3)
+		buf := encodedConfig(uint16(len(payload)), payload)
+		buf.WriteByte(42)
+		cfg, err := readConfig(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.WifiSSID != "ssid" || cfg.WifiMode != WifiModeAP {
+			t.Errorf("readConfig() = %+v", cfg)
+		}
+		if b, _ := buf.ReadByte(); b != 42 {
+			t.Errorf("readConfig() didn't consume the whole payload")
+		}
+	})
+}
+
+func TestUnknownCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(io.Reader) (Frame, error)
+		cmd    byte
+	}{
+		{"device", Decode, 200},
+		{"device with client command", Decode, CmdHello},
+		{"client", DecodeRequest, 250},
+		{"client with device command", DecodeRequest, CmdPrintStdout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.decode(bytes.NewReader([]byte{tt.cmd, 1, 2, 3}))
+			uerr, ok := err.(*UnknownCommandError)
+			if !ok {
+				t.Fatalf("error = %v, want *UnknownCommandError", err)
+			}
+			if uerr.Cmd != tt.cmd {
+				t.Errorf("Cmd = %d, want %d", uerr.Cmd, tt.cmd)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, f := range deviceFrames {
+		var buf bytes.Buffer
+		Encode(&buf, f)
+		data := buf.Bytes()
+		if len(data) == 1 {
+			// No payload
+			continue
+		}
+		if _, err := Decode(bytes.NewReader(data[:len(data)-1])); err == nil {
+			t.Errorf("decoding truncated %T didn't fail", f)
+		}
+	}
+}
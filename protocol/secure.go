@@ -0,0 +1,258 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// MinKeySize is the minimum size of a pre-shared key
+	MinKeySize = 16
+	// maxRecordSize is the maximum size of the plaintext in
+	// an encrypted record
+	maxRecordSize = 16 * 1024
+)
+
+var (
+	// ErrAuthFailed is returned when the other side of the connection
+	// fails to prove it knows the pre-shared key
+	ErrAuthFailed = errors.New("authentication failed, keys don't match")
+)
+
+// Labels used to derive the MACs and keys from the pre-shared key
+const (
+	labelDeviceMAC = "wmonitor device mac"
+	labelClientMAC = "wmonitor client mac"
+	labelClientKey = "wmonitor client key"
+	labelDeviceKey = "wmonitor device key"
+)
+
+func authMAC(key []byte, label string, clientNonce []byte, deviceNonce []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	h.Write(clientNonce)
+	h.Write(deviceNonce)
+	return h.Sum(nil)
+}
+
+func newAEAD(key []byte, label string, clientNonce []byte, deviceNonce []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(authMAC(key, label, clientNonce, deviceNonce))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SecureConn is a net.Conn which encrypts and authenticates all the data
+// sent over the underlying connection. It's returned by ClientHandshake
+// and ServerHandshake.
+//
+// Data is sent in records, each one starting with its size as an uint16,
+// followed by the plaintext encrypted with AES-256-GCM. The nonce is the
+// number of records previously sent in the same direction, as a big
+// endian uint64 preceded by 4 zero bytes.
+type SecureConn struct {
+	net.Conn
+
+	rmu    sync.Mutex
+	rAEAD  cipher.AEAD
+	rSeq   uint64
+	raw    []byte // partially read record
+	plain  []byte // decrypted data not yet returned by Read
+	rError error
+
+	wmu   sync.Mutex
+	wAEAD cipher.AEAD
+	wSeq  uint64
+}
+
+func newSecureConn(conn net.Conn, key []byte, clientNonce []byte, deviceNonce []byte, client bool) (*SecureConn, error) {
+	clientAEAD, err := newAEAD(key, labelClientKey, clientNonce, deviceNonce)
+	if err != nil {
+		return nil, err
+	}
+	deviceAEAD, err := newAEAD(key, labelDeviceKey, clientNonce, deviceNonce)
+	if err != nil {
+		return nil, err
+	}
+	c := &SecureConn{Conn: conn}
+	if client {
+		c.wAEAD, c.rAEAD = clientAEAD, deviceAEAD
+	} else {
+		c.wAEAD, c.rAEAD = deviceAEAD, clientAEAD
+	}
+	return c, nil
+}
+
+func recordNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// Read reads decrypted data from the connection. If a read from the
+// underlying connection fails in the middle of a record (e.g. due to a
+// timeout), the partial record is kept and Read can be called again.
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.plain) == 0 {
+		if c.rError != nil {
+			return 0, c.rError
+		}
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *SecureConn) fill(size int) error {
+	for len(c.raw) < size {
+		buf := make([]byte, size-len(c.raw))
+		n, err := c.Conn.Read(buf)
+		c.raw = append(c.raw, buf[:n]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *SecureConn) readRecord() error {
+	if err := c.fill(2); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint16(c.raw))
+	if err := c.fill(2 + size); err != nil {
+		return err
+	}
+	plain, err := c.rAEAD.Open(nil, recordNonce(c.rSeq), c.raw[2:2+size], nil)
+	c.raw = c.raw[:0]
+	if err != nil {
+		// The stream can't be trusted anymore
+		c.rError = fmt.Errorf("error decrypting record: %v", err)
+		return c.rError
+	}
+	c.rSeq++
+	c.plain = plain
+	return nil
+}
+
+// Write encrypts p and writes it to the connection
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		sealed := c.wAEAD.Seal(nil, recordNonce(c.wSeq), chunk, nil)
+		c.wSeq++
+		record := make([]byte, 2, 2+len(sealed))
+		binary.BigEndian.PutUint16(record, uint16(len(sealed)))
+		record = append(record, sealed...)
+		if _, err := c.Conn.Write(record); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, AuthNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+func checkKey(key []byte) error {
+	if len(key) < MinKeySize {
+		return fmt.Errorf("key is too short (%d bytes, minimum is %d)", len(key), MinKeySize)
+	}
+	return nil
+}
+
+// ClientHandshake authenticates the device on the other side of conn
+// using the given pre-shared key and returns a connection which encrypts
+// all the data. Callers should set a deadline on conn, since devices which
+// don't support authentication won't reply.
+func ClientHandshake(conn net.Conn, key []byte) (*SecureConn, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	init := &AuthInitFrame{}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	copy(init.Nonce[:], nonce)
+	if err := Encode(conn, init); err != nil {
+		return nil, err
+	}
+	f, err := Decode(conn)
+	if err != nil {
+		return nil, err
+	}
+	challenge, ok := f.(*AuthChallengeFrame)
+	if !ok {
+		return nil, fmt.Errorf("device sent command %d instead of authenticating, it might not have a key configured", f.Cmd())
+	}
+	expected := authMAC(key, labelDeviceMAC, init.Nonce[:], challenge.Nonce[:])
+	if !hmac.Equal(expected, challenge.MAC[:]) {
+		return nil, ErrAuthFailed
+	}
+	proof := &AuthProofFrame{}
+	copy(proof.MAC[:], authMAC(key, labelClientMAC, init.Nonce[:], challenge.Nonce[:]))
+	if err := Encode(conn, proof); err != nil {
+		return nil, err
+	}
+	return newSecureConn(conn, key, init.Nonce[:], challenge.Nonce[:], true)
+}
+
+// ServerHandshake implements the device side of the handshake, after
+// the CmdAuthInit frame sent by the client has been read from conn.
+func ServerHandshake(conn net.Conn, key []byte, init *AuthInitFrame) (*SecureConn, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	challenge := &AuthChallengeFrame{}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	copy(challenge.Nonce[:], nonce)
+	copy(challenge.MAC[:], authMAC(key, labelDeviceMAC, init.Nonce[:], challenge.Nonce[:]))
+	if err := Encode(conn, challenge); err != nil {
+		return nil, err
+	}
+	f, err := DecodeRequest(conn)
+	if err != nil {
+		return nil, err
+	}
+	proof, ok := f.(*AuthProofFrame)
+	if !ok {
+		return nil, fmt.Errorf("unexpected command %d during authentication", f.Cmd())
+	}
+	expected := authMAC(key, labelClientMAC, init.Nonce[:], challenge.Nonce[:])
+	if !hmac.Equal(expected, proof.MAC[:]) {
+		return nil, ErrAuthFailed
+	}
+	return newSecureConn(conn, key, init.Nonce[:], challenge.Nonce[:], false)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// reconnectMultiplier is the factor the delay between reconnection
+	// attempts grows by after each failed attempt
+	reconnectMultiplier = 2
+	// reconnectMaxDoublings caps the growth of the delay when there's
+	// no MaxDelay, so it doesn't overflow after many attempts
+	reconnectMaxDoublings = 16
+	// reconnectMinUptime is the time a connection must stay up before
+	// the attempts are reset, so hosts which accept the connection and
+	// fail right away (e.g. during the handshake) still back off
+	reconnectMinUptime = 10 * time.Second
+)
+
+// ReconnectPolicy determines how to reconnect to a host after
+// losing the connection to it
+type ReconnectPolicy struct {
+	// Delay is the delay before the first attempt. It's doubled
+	// after each failed attempt, up to MaxDelay. Must be positive.
+	Delay time.Duration
+	// MaxDelay is the maximum delay between attempts, zero
+	// for no limit
+	MaxDelay time.Duration
+	// Jitter randomizes each delay by up to the given fraction
+	// of it, in both directions, so several clients don't try to
+	// reconnect at the same time. Must be in [0, 1].
+	Jitter float64
+	// MaxAttempts is the number of attempts before giving up,
+	// zero for no limit
+	MaxAttempts int
+	// Timeout is the time without a connection before giving up,
+	// zero for no limit
+	Timeout time.Duration
+}
+
+// Validate returns an error if the policy is not valid
+func (p *ReconnectPolicy) Validate() error {
+	if p.Delay <= 0 {
+		return fmt.Errorf("reconnect delay must be positive, not %v", p.Delay)
+	}
+	if p.MaxDelay < 0 || p.Timeout < 0 {
+		return fmt.Errorf("reconnect maximum delay and timeout can't be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("reconnect jitter must be between 0 and 1, not %v", p.Jitter)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("reconnect attempts can't be negative")
+	}
+	return nil
+}
+
+// backoff returns the delay before the given attempt, starting at 1
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.Delay)
+	for ii := 1; ii < attempt && ii <= reconnectMaxDoublings && (p.MaxDelay == 0 || delay < float64(p.MaxDelay)); ii++ {
+		delay *= reconnectMultiplier
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// reconnector tracks the attempts to reconnect to a host,
+// according to a ReconnectPolicy
+type reconnector struct {
+	policy *ReconnectPolicy
+
+	mu sync.Mutex
+	// lost is the time the connection was lost, zero if it
+	// stayed up for reconnectMinUptime
+	lost time.Time
+	// up is the time of the last connection, zero while
+	// disconnected
+	up       time.Time
+	attempts int
+}
+
+func newReconnector(policy *ReconnectPolicy) *reconnector {
+	return &reconnector{policy: policy}
+}
+
+// next must be called when the connection is lost or an attempt to
+// reconnect fails. It returns the time to wait before the next attempt,
+// or an error if the policy says we should give up.
+func (r *reconnector) next(host string) (time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.up.IsZero() {
+		if time.Since(r.up) >= reconnectMinUptime {
+			// The connection was stable, start over
+			r.lost = time.Time{}
+			r.attempts = 0
+		}
+		r.up = time.Time{}
+	}
+	if r.lost.IsZero() {
+		r.lost = time.Now()
+	}
+	downtime := time.Since(r.lost)
+	if max := r.policy.MaxAttempts; max > 0 && r.attempts >= max {
+		return 0, fmt.Errorf("giving up on %s after %d reconnection attempts, down for %v", host, r.attempts, roundDuration(downtime))
+	}
+	if timeout := r.policy.Timeout; timeout > 0 && downtime >= timeout {
+		return 0, fmt.Errorf("giving up on %s after %v without a connection", host, roundDuration(downtime))
+	}
+	r.attempts++
+	return r.policy.backoff(r.attempts), nil
+}
+
+// remaining returns the time left before giving up according to the
+// policy timeout, or zero if there's no timeout or we're connected
+func (r *reconnector) remaining() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lost.IsZero() || !r.up.IsZero() || r.policy.Timeout == 0 {
+		return 0
+	}
+	if left := r.policy.Timeout - time.Since(r.lost); left > 0 {
+		return left
+	}
+	return time.Nanosecond
+}
+
+// connected must be called after connecting. If the connection had been
+// lost before, it returns the number of attempts and the downtime. The
+// attempts are only reset once the connection stays up for
+// reconnectMinUptime.
+func (r *reconnector) connected() (attempts int, downtime time.Duration, reconnected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.up = time.Now()
+	if r.lost.IsZero() {
+		return 0, 0, false
+	}
+	return r.attempts, time.Since(r.lost), true
+}
+
+// attempt returns the number of the current attempt
+func (r *reconnector) attempt() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(100 * time.Millisecond)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconnectPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ReconnectPolicy
+		valid  bool
+	}{
+		{"defaults", ReconnectPolicy{Delay: time.Second, MaxDelay: 30 * time.Second, Jitter: 0.2}, true},
+		{"no limits", ReconnectPolicy{Delay: time.Second}, true},
+		{"zero delay", ReconnectPolicy{}, false},
+		{"negative delay", ReconnectPolicy{Delay: -time.Second}, false},
+		{"negative max delay", ReconnectPolicy{Delay: time.Second, MaxDelay: -time.Second}, false},
+		{"negative timeout", ReconnectPolicy{Delay: time.Second, Timeout: -time.Second}, false},
+		{"jitter too big", ReconnectPolicy{Delay: time.Second, Jitter: 1.5}, false},
+		{"negative jitter", ReconnectPolicy{Delay: time.Second, Jitter: -0.1}, false},
+		{"negative attempts", ReconnectPolicy{Delay: time.Second, MaxAttempts: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid = %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	p := &ReconnectPolicy{Delay: time.Second, MaxDelay: 10 * time.Second}
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for ii, w := range want {
+		if got := p.backoff(ii + 1); got != w*time.Second {
+			t.Errorf("backoff(%d) = %v, want %v", ii+1, got, w*time.Second)
+		}
+	}
+}
+
+func TestReconnectBackoffNoMaxDelay(t *testing.T) {
+	p := &ReconnectPolicy{Delay: time.Second}
+	prev := time.Duration(0)
+	for attempt := 1; attempt <= 1000; attempt++ {
+		p.Jitter = 0
+		delay := p.backoff(attempt)
+		if delay < prev {
+			t.Fatalf("backoff(%d) = %v, less than the previous %v", attempt, delay, prev)
+		}
+		prev = delay
+		p.Jitter = 1
+		if jittered := p.backoff(attempt); jittered < 0 || jittered > 2*delay {
+			t.Fatalf("backoff(%d) with jitter = %v, want in [0, %v]", attempt, jittered, 2*delay)
+		}
+	}
+	if max := time.Second << reconnectMaxDoublings; prev != max {
+		t.Errorf("delay grew up to %v, want %v", prev, max)
+	}
+}
+
+func TestReconnectBackoffJitter(t *testing.T) {
+	p := &ReconnectPolicy{Delay: time.Second, MaxDelay: 4 * time.Second, Jitter: 0.25}
+	for attempt := 1; attempt <= 5; attempt++ {
+		base := time.Second << uint(attempt-1)
+		if base > p.MaxDelay {
+			base = p.MaxDelay
+		}
+		min, max := base*3/4, base*5/4
+		for ii := 0; ii < 100; ii++ {
+			if delay := p.backoff(attempt); delay < min || delay > max {
+				t.Fatalf("backoff(%d) = %v, want in [%v, %v]", attempt, delay, min, max)
+			}
+		}
+	}
+}
+
+func TestReconnectorGivesUp(t *testing.T) {
+	r := newReconnector(&ReconnectPolicy{Delay: time.Millisecond, MaxAttempts: 2})
+	for ii := 0; ii < 2; ii++ {
+		if _, err := r.next("dev"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.next("dev"); err == nil || !strings.Contains(err.Error(), "2 reconnection attempts") {
+		t.Errorf("next() after MaxAttempts = %v, want giving up error", err)
+	}
+
+	r = newReconnector(&ReconnectPolicy{Delay: time.Millisecond, Timeout: 50 * time.Millisecond})
+	if _, err := r.next("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if left := r.remaining(); left <= 0 || left > 50*time.Millisecond {
+		t.Errorf("remaining() = %v, want in (0, 50ms]", left)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := r.next("dev"); err == nil || !strings.Contains(err.Error(), "without a connection") {
+		t.Errorf("next() after Timeout = %v, want giving up error", err)
+	}
+	if attempts, _, ok := r.connected(); !ok || attempts != 1 {
+		t.Errorf("connected() = %d, %v, want 1, true", attempts, ok)
+	}
+	if left := r.remaining(); left != 0 {
+		t.Errorf("remaining() while connected = %v, want 0", left)
+	}
+}
+
+func TestReconnectorBacksOffShortConnections(t *testing.T) {
+	r := newReconnector(&ReconnectPolicy{Delay: time.Second})
+	r.connected()
+	// The host accepts the connection and fails right away
+	for attempt := 1; attempt <= 3; attempt++ {
+		delay, err := r.next("dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := time.Second << uint(attempt-1); delay != want {
+			t.Errorf("attempt %d delay = %v, want %v", attempt, delay, want)
+		}
+		if attempts, _, ok := r.connected(); !ok || attempts != attempt {
+			t.Errorf("connected() = %d, %v, want %d, true", attempts, ok, attempt)
+		}
+	}
+	// Once the connection is stable, it starts over
+	r.up = time.Now().Add(-reconnectMinUptime)
+	if delay, _ := r.next("dev"); delay != time.Second || r.attempt() != 1 {
+		t.Errorf("delay after a stable connection = %v at attempt %d, want 1s at attempt 1", delay, r.attempt())
+	}
+}
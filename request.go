@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// pendingRequest is a request waiting for a reply from the host. The
+// protocol has no request identifiers, but the host replies to the
+// requests in order, so each reply is matched with the oldest request
+// waiting for a frame with its command.
+type pendingRequest struct {
+	reply byte
+	ch    chan protocol.Frame
+	// canceled is set when the caller stops waiting. The request
+	// is kept in the queue, so its reply is discarded rather than
+	// delivered to the next request.
+	canceled bool
+}
+
+// request sends f to the host and waits for the reply, a frame with
+// the given command. If ctx is done first, it returns ctx.Err() and
+// the reply is discarded when it arrives.
+func (c *Client) request(ctx context.Context, f protocol.Frame, reply byte) (protocol.Frame, error) {
+	req := &pendingRequest{reply: reply, ch: make(chan protocol.Frame, 1)}
+	c.stateMu.Lock()
+	connected := c.conn != nil
+	if connected {
+		c.requests = append(c.requests, req)
+	}
+	c.stateMu.Unlock()
+	if !connected {
+		return nil, errors.New("not connected")
+	}
+	if err := c.send(f); err != nil {
+		c.removeRequest(req)
+		return nil, err
+	}
+	select {
+	case frame, ok := <-req.ch:
+		if !ok {
+			return nil, fmt.Errorf("connection to %s lost while waiting for %s", c.hostName(), protocol.CommandName(reply))
+		}
+		return frame, nil
+	case <-ctx.Done():
+		c.stateMu.Lock()
+		req.canceled = true
+		c.stateMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeRequest(req *pendingRequest) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for ii, v := range c.requests {
+		if v == req {
+			c.requests = append(c.requests[:ii], c.requests[ii+1:]...)
+			break
+		}
+	}
+}
+
+// deliverReply delivers the frame to the oldest request waiting
+// for it, returning false if there's none
+func (c *Client) deliverReply(frame protocol.Frame) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for ii, v := range c.requests {
+		if v.reply == frame.Cmd() {
+			c.requests = append(c.requests[:ii], c.requests[ii+1:]...)
+			if !v.canceled {
+				v.ch <- frame
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// failRequestsLocked makes the pending requests return an error, since
+// their replies won't arrive. It must be called with stateMu held when
+// the connection is closed or replaced.
+func (c *Client) failRequestsLocked() {
+	for _, v := range c.requests {
+		close(v.ch)
+	}
+	c.requests = nil
+}
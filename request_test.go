@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/protocol"
+)
+
+// scriptedHost accepts a single connection, completes the handshake
+// and answers the pings, forwarding the other frames it receives to
+// the test, which decides how to reply
+type scriptedHost struct {
+	ln     net.Listener
+	conns  chan net.Conn
+	frames chan protocol.Frame
+}
+
+func startScriptedHost(t *testing.T) *scriptedHost {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &scriptedHost{ln: ln, conns: make(chan net.Conn, 1), frames: make(chan protocol.Frame, 16)}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		h.conns <- conn
+		for {
+			f, err := protocol.DecodeRequest(conn)
+			if err != nil {
+				return
+			}
+			if _, ok := f.(*protocol.HelloFrame); ok {
+				protocol.Encode(conn, &protocol.InfoFrame{ProtocolVersion: protocol.Version, Commands: protocol.Commands()})
+				continue
+			}
+			if _, ok := f.(*protocol.PingFrame); ok {
+				protocol.Encode(conn, &protocol.PongFrame{})
+				continue
+			}
+			h.frames <- f
+		}
+	}()
+	return h
+}
+
+// connect returns a client connected to the host, with Run
+// running in its own goroutine
+func (h *scriptedHost) connect(t *testing.T) (*Client, net.Conn) {
+	t.Helper()
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), &lockedBuffer{}, &lockedBuffer{})
+	c.Host = &Host{Host: "scripted", Addrs: []string{h.ln.Addr().String()}}
+	c.IgnoreCoreDumps = true
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go c.Run(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.WaitHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c, <-h.conns
+}
+
+func (h *scriptedHost) close() {
+	h.ln.Close()
+}
+
+// receive waits for the host to receive a frame with the given command
+func (h *scriptedHost) receive(t *testing.T, cmd byte) {
+	t.Helper()
+	select {
+	case f := <-h.frames:
+		if f.Cmd() != cmd {
+			t.Fatalf("host received %s, want %s", protocol.CommandName(f.Cmd()), protocol.CommandName(cmd))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", protocol.CommandName(cmd))
+	}
+}
+
+type requestResult struct {
+	frame protocol.Frame
+	err   error
+}
+
+func startRequest(ctx context.Context, c *Client, f protocol.Frame, reply byte) <-chan requestResult {
+	ch := make(chan requestResult, 1)
+	go func() {
+		frame, err := c.request(ctx, f, reply)
+		ch <- requestResult{frame, err}
+	}()
+	return ch
+}
+
+func configReply(ssid string) protocol.Frame {
+	return &protocol.ConfigFrame{Config: &protocol.Config{Version: protocol.ConfigVersion, WifiSSID: ssid}}
+}
+
+func waitConfigReply(t *testing.T, ch <-chan requestResult, ssid string) {
+	t.Helper()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			t.Fatalf("request() = %v", res.err)
+		}
+		cfg, ok := res.frame.(*protocol.ConfigFrame)
+		if !ok || cfg.Config.WifiSSID != ssid {
+			t.Errorf("request() = %#v, want config with SSID %q", res.frame, ssid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reply")
+	}
+}
+
+func TestRequestRepliesInOrder(t *testing.T) {
+	h := startScriptedHost(t)
+	defer h.close()
+	c, conn := h.connect(t)
+	defer c.Close()
+
+	first := startRequest(context.Background(), c, &protocol.GetConfigFrame{}, protocol.CmdConfig)
+	h.receive(t, protocol.CmdGetConfig)
+	coredump := startRequest(context.Background(), c, &protocol.CoredumpReadFrame{}, protocol.CmdCoredumpRead)
+	h.receive(t, protocol.CmdCoredumpRead)
+	second := startRequest(context.Background(), c, &protocol.GetConfigFrame{}, protocol.CmdConfig)
+	h.receive(t, protocol.CmdGetConfig)
+
+	// Replies are matched by command, then in the order
+	// the requests were sent
+	protocol.Encode(conn, configReply("first"))
+	protocol.Encode(conn, &protocol.CoredumpFrame{})
+	protocol.Encode(conn, configReply("second"))
+	waitConfigReply(t, first, "first")
+	waitConfigReply(t, second, "second")
+	select {
+	case res := <-coredump:
+		if res.err != nil || res.frame.Cmd() != protocol.CmdCoredumpRead {
+			t.Errorf("coredump request() = %v, %v", res.frame, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the coredump")
+	}
+}
+
+func TestRequestCanceledKeepsItsReply(t *testing.T) {
+	h := startScriptedHost(t)
+	defer h.close()
+	c, conn := h.connect(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := startRequest(ctx, c, &protocol.GetConfigFrame{}, protocol.CmdConfig)
+	h.receive(t, protocol.CmdGetConfig)
+	cancel()
+	if res := <-canceled; res.err != context.Canceled {
+		t.Fatalf("canceled request() = %v, %v, want %v", res.frame, res.err, context.Canceled)
+	}
+	next := startRequest(context.Background(), c, &protocol.GetConfigFrame{}, protocol.CmdConfig)
+	h.receive(t, protocol.CmdGetConfig)
+
+	// The reply to the canceled request arrives late, it
+	// must not be delivered to the next one
+	protocol.Encode(conn, configReply("canceled"))
+	protocol.Encode(conn, configReply("next"))
+	waitConfigReply(t, next, "next")
+}
+
+func TestRequestFailsOnClose(t *testing.T) {
+	h := startScriptedHost(t)
+	defer h.close()
+	c, _ := h.connect(t)
+
+	pending := startRequest(context.Background(), c, &protocol.GetConfigFrame{}, protocol.CmdConfig)
+	h.receive(t, protocol.CmdGetConfig)
+	c.Close()
+	select {
+	case res := <-pending:
+		if res.err == nil {
+			t.Errorf("request() = %v after Close(), want an error", res.frame)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request didn't return after Close()")
+	}
+	if _, err := c.request(context.Background(), &protocol.GetConfigFrame{}, protocol.CmdConfig); err == nil {
+		t.Error("request() while disconnected = nil, want an error")
+	}
+}
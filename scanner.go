@@ -2,21 +2,179 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/fiam/idf_wmonitor/protocol"
 	"github.com/micro/mdns"
 )
 
 type Host struct {
 	Host string
-	Addr string
+	// Addrs contains the addresses of the host in host:port format,
+	// sorted by preference. Client.Connect tries them in order.
+	Addrs []string
 }
 
+// ResolveHost returns the Host for connecting directly to addr, given in
+// host:port format, without scanning. The host might be either an IP
+// address or a name, which is resolved using DNS in the given timeout.
+func ResolveHost(addr string, policy AddressPolicy, timeout time.Duration) (*Host, error) {
+	name, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q, must be host:port", addr)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return nil, fmt.Errorf("invalid port in %q: %v", addr, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %v", name, err)
+	}
+	var v4, v6 []string
+	for _, ip := range ips {
+		s := ip.IP.String()
+		if ip.Zone != "" {
+			s += "%" + ip.Zone
+		}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(s, port))
+		} else {
+			v6 = append(v6, net.JoinHostPort(s, port))
+		}
+	}
+	addrs := append(v4, v6...)
+	if policy == PreferIPv6 {
+		addrs = append(v6, v4...)
+	}
+	return &Host{Host: name, Addrs: addrs}, nil
+}
+
+// AddressPolicy determines the preferred address family when
+// a host has both IPv4 and IPv6 addresses
+type AddressPolicy int
+
+const (
+	PreferIPv4 AddressPolicy = iota
+	PreferIPv6
+)
+
+// ParseAddressPolicy parses an AddressPolicy, either "ipv4" or "ipv6"
+func ParseAddressPolicy(s string) (AddressPolicy, error) {
+	switch strings.ToLower(s) {
+	case "ipv4", "v4", "4":
+		return PreferIPv4, nil
+	case "ipv6", "v6", "6":
+		return PreferIPv6, nil
+	}
+	return PreferIPv4, fmt.Errorf("invalid address preference %q, must be ipv4 or ipv6", s)
+}
+
+// HostInfo is the information advertised by a host over mDNS
+type HostInfo struct {
+	Host string `json:"host"`
+	IPv4 string `json:"ipv4,omitempty"`
+	// IPv6 includes the zone for link-local addresses
+	// (e.g. fe80::1%en0)
+	IPv6 string `json:"ipv6,omitempty"`
+	Port int    `json:"port"`
+	// TXT contains the fields in the TXT record, see the TXT*
+	// constants in the protocol package for the known ones
+	TXT map[string]string `json:"txt,omitempty"`
+}
+
+// newHostInfo returns the HostInfo for an entry received on the
+// given interface, which might be nil if unknown
+func newHostInfo(entry *mdns.ServiceEntry, iface *net.Interface) *HostInfo {
+	info := &HostInfo{
+		Host: entry.Host,
+		Port: entry.Port,
+	}
+	if entry.AddrV4 != nil {
+		info.IPv4 = entry.AddrV4.String()
+	}
+	if entry.AddrV6 != nil {
+		info.IPv6 = entry.AddrV6.String()
+		if entry.AddrV6.IsLinkLocalUnicast() && iface != nil {
+			// Link-local addresses are only meaningful
+			// together with their interface
+			info.IPv6 += "%" + iface.Name
+		}
+	}
+	for _, v := range entry.InfoFields {
+		if v == "" {
+			continue
+		}
+		if info.TXT == nil {
+			info.TXT = make(map[string]string)
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			info.TXT[kv[0]] = kv[1]
+		} else {
+			info.TXT[kv[0]] = ""
+		}
+	}
+	return info
+}
+
+// merge fills the missing addresses in h with the ones from other,
+// which describes the same host received on another interface
+func (h *HostInfo) merge(other *HostInfo) {
+	if h.IPv4 == "" {
+		h.IPv4 = other.IPv4
+	}
+	if h.IPv6 == "" {
+		h.IPv6 = other.IPv6
+	}
+	if h.TXT == nil {
+		h.TXT = other.TXT
+	}
+}
+
+// Addrs returns the addresses of the host in host:port format,
+// sorted according to the given policy
+func (h *HostInfo) Addrs(policy AddressPolicy) []string {
+	port := strconv.Itoa(h.Port)
+	var addrs []string
+	for _, ip := range []string{h.IPv4, h.IPv6} {
+		if ip != "" {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	if policy == PreferIPv6 && len(addrs) == 2 {
+		addrs[0], addrs[1] = addrs[1], addrs[0]
+	}
+	return addrs
+}
+
+// mdnsQuery sends the mDNS queries, tests replace it to
+// simulate the replies
+var mdnsQuery = mdns.Query
+
 type Scanner struct {
+	// Timeout is the time each mDNS query waits for replies. Zero
+	// uses the default timeout.
+	Timeout time.Duration
+	// Policy determines the order of the addresses in the
+	// hosts returned by Scan
+	Policy AddressPolicy
+	// Inventory is checked by Scan before scanning over mDNS,
+	// when the host filter matches a device name
+	Inventory *Inventory
+	// Errors receives the error when Scan ends without finding
+	// a host, e.g. because the user can't pick one. If it's nil,
+	// the error is dropped.
+	Errors chan<- error
+
 	host        string
 	interactive bool
 	stdin       io.Reader
@@ -34,10 +192,24 @@ func NewScanner(host string, interactive bool, stdin io.Reader, stdout io.Writer
 	}
 }
 
-func (s *Scanner) replyWithEntry(entry *mdns.ServiceEntry) {
-	s.ch <- &Host{
-		Host: entry.Host,
-		Addr: entry.AddrV4.String() + ":" + strconv.Itoa(entry.Port),
+func (s *Scanner) replyWithEntry(ctx context.Context, entry *HostInfo) {
+	host := &Host{
+		Host:  entry.Host,
+		Addrs: entry.Addrs(s.Policy),
+	}
+	select {
+	case s.ch <- host:
+	case <-ctx.Done():
+	}
+}
+
+func (s *Scanner) replyWithError(ctx context.Context, err error) {
+	if s.Errors == nil {
+		return
+	}
+	select {
+	case s.Errors <- err:
+	case <-ctx.Done():
 	}
 }
 
@@ -47,7 +219,7 @@ func (s *Scanner) printf(format string, args ...interface{}) {
 	}
 }
 
-func (s *Scanner) askForEntry(entries []*mdns.ServiceEntry) {
+func (s *Scanner) askForEntry(entries []*HostInfo) (*HostInfo, error) {
 	s.printf("found %d hosts\n", len(entries))
 	for ii, v := range entries {
 		s.printf("[%d]\t %s\n", ii+1, v.Host)
@@ -57,8 +229,11 @@ func (s *Scanner) askForEntry(entries []*mdns.ServiceEntry) {
 	for {
 		st, err := r.ReadString('\n')
 		if err != nil {
-			s.printf("error reading input: %v\n", err)
-			continue
+			if err == io.EOF {
+				// No more input, the user can't pick a host
+				return nil, fmt.Errorf("%d hosts found, but there's no input to select one", len(entries))
+			}
+			return nil, fmt.Errorf("error reading input: %v", err)
 		}
 		st = strings.TrimSpace(st)
 		n, err := strconv.Atoi(st)
@@ -70,40 +245,203 @@ func (s *Scanner) askForEntry(entries []*mdns.ServiceEntry) {
 			s.printf("%d is out of range [%d-%d]\n", n, 1, len(entries))
 			continue
 		}
-		s.replyWithEntry(entries[n-1])
-		break
+		return entries[n-1], nil
 	}
 }
 
-func (s *Scanner) Scan() {
+// multicastInterfaces returns the interfaces that mDNS queries
+// should be sent on
+func multicastInterfaces() []*net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var result []*net.Interface
+	for ii := range ifaces {
+		iface := &ifaces[ii]
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+			result = append(result, iface)
+		}
+	}
+	return result
+}
+
+func (s *Scanner) query(iface *net.Interface) ([]*HostInfo, error) {
+	results := make(chan *mdns.ServiceEntry, 16)
+	var hosts []*HostInfo
+	done := make(chan struct{})
+	filter := normalizeHostName(s.host)
+	go func() {
+		for entry := range results {
+			if !strings.Contains(normalizeHostName(entry.Host), filter) {
+				continue
+			}
+			hosts = append(hosts, newHostInfo(entry, iface))
+		}
+		close(done)
+	}()
+	params := mdns.DefaultParams(protocol.ServiceName)
+	params.Entries = results
+	params.Interface = iface
+	if s.Timeout > 0 {
+		params.Timeout = s.Timeout
+	}
+	err := mdnsQuery(params)
+	close(results)
+	<-done
+	return hosts, err
+}
+
+// Lookup performs a single mDNS query on every multicast interface,
+// returning the information advertised by the hosts matching the host
+// filter sorted by name. Querying each interface separately allows
+// determining the zone of link-local IPv6 addresses.
+func (s *Scanner) Lookup() ([]*HostInfo, error) {
+	ifaces := multicastInterfaces()
+	if len(ifaces) == 0 {
+		// Let the mDNS library pick the interface
+		ifaces = []*net.Interface{nil}
+	}
+	type result struct {
+		hosts []*HostInfo
+		err   error
+	}
+	results := make(chan result, len(ifaces))
+	for _, v := range ifaces {
+		go func(iface *net.Interface) {
+			hosts, err := s.query(iface)
+			results <- result{hosts, err}
+		}(v)
+	}
+	var hosts []*HostInfo
+	byName := make(map[string]*HostInfo)
+	var err error
+	failed := 0
+	for range ifaces {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			failed++
+			continue
+		}
+		for _, v := range res.hosts {
+			if prev := byName[v.Host]; prev != nil {
+				prev.merge(v)
+				continue
+			}
+			byName[v.Host] = v
+			hosts = append(hosts, v)
+		}
+	}
+	if failed == len(ifaces) {
+		return nil, err
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts, nil
+}
+
+// Scan looks for a host matching the host filter in the background,
+// sending it to the channel passed to NewScanner. If more than one host
+// matches, the user is asked to pick one, and if they can't, the error
+// is sent to s.Errors. The search stops when ctx is done.
+func (s *Scanner) Scan(ctx context.Context) {
+	if dev := s.Inventory.Find(s.host); dev != nil {
+		host := dev.Host()
+		s.printf("found host %s in inventory at %s\n", host.Host, host.Addrs[0])
+		s.ch <- host
+		return
+	}
 	if s.host == "" {
 		s.printf("scanning for hosts...\n")
 	} else {
 		s.printf("waiting for host %s...\n", s.host)
 	}
 	go func() {
-		for {
-			results := make(chan *mdns.ServiceEntry, 16)
-			if err := mdns.Lookup("_esp32wmonitor._tcp", results); err != nil {
-				panic(err)
-			}
-			close(results)
-			var entries []*mdns.ServiceEntry
-			for entry := range results {
-				if s.host != "" && !strings.Contains(entry.Host, s.host) {
-					continue
-				}
-				entries = append(entries, entry)
-			}
-			if len(entries) > 0 {
+		for ctx.Err() == nil {
+			entries, err := s.Lookup()
+			if err != nil {
+				// Might be a transient network error, keep trying
+				fmt.Fprintf(s.stdout, "error scanning for hosts: %v\n", err)
+			} else if len(entries) > 0 {
+				entry := entries[0]
 				if len(entries) > 1 {
-					s.askForEntry(entries)
-				} else {
-					s.replyWithEntry(entries[0])
+					if entry, err = s.askForEntry(entries); err != nil {
+						s.replyWithError(ctx, err)
+						return
+					}
 				}
+				s.replyWithEntry(ctx, entry)
 				return
 			}
-			time.Sleep(time.Second)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
 		}
 	}()
 }
+
+// Find waits up to timeout for a host matching the host filter,
+// without asking the user to pick one. It returns an error listing
+// the hosts if more than one matches.
+func (s *Scanner) Find(timeout time.Duration) (*Host, error) {
+	if dev := s.Inventory.Find(s.host); dev != nil {
+		return dev.Host(), nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		hosts, err := s.Hosts()
+		if err != nil {
+			fmt.Fprintf(s.stdout, "error scanning for hosts: %v\n", err)
+		}
+		if len(hosts) == 1 {
+			return hosts[0], nil
+		}
+		if len(hosts) > 1 {
+			names := make([]string, len(hosts))
+			for ii, v := range hosts {
+				names[ii] = v.Host
+			}
+			return nil, fmt.Errorf("%d hosts found (%s), select one with -host or -addr", len(hosts), strings.Join(names, ", "))
+		}
+		if time.Now().After(deadline) {
+			if s.host != "" {
+				return nil, fmt.Errorf("host %s not found in %v", s.host, timeout)
+			}
+			return nil, fmt.Errorf("no hosts found in %v", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Hosts returns all the hosts matching the host filter: the devices
+// in the inventory whose name contains it, followed by the hosts found
+// over mDNS which are not in the inventory. Since mDNS doesn't reach
+// every network, errors scanning are ignored when there are matching
+// devices in the inventory.
+func (s *Scanner) Hosts() ([]*Host, error) {
+	var hosts []*Host
+	filter := normalizeHostName(s.host)
+	if s.Inventory != nil {
+		for _, v := range s.Inventory.Devices {
+			if strings.Contains(normalizeHostName(v.Name), filter) {
+				hosts = append(hosts, v.Host())
+			}
+		}
+	}
+	entries, err := s.Lookup()
+	if err != nil {
+		if len(hosts) > 0 {
+			return hosts, nil
+		}
+		return nil, err
+	}
+	for _, v := range entries {
+		if s.Inventory.Find(v.Host) == nil {
+			hosts = append(hosts, &Host{Host: v.Host, Addrs: v.Addrs(s.Policy)})
+		}
+	}
+	return hosts, nil
+}
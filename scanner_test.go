@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/micro/mdns"
+)
+
+func TestAskForEntry(t *testing.T) {
+	entries := []*HostInfo{{Host: "a.local."}, {Host: "b.local."}}
+	tests := []struct {
+		input string
+		want  *HostInfo
+	}{
+		{"2\n", entries[1]},
+		{"x\n0\n3\n1\n", entries[0]},
+		{"", nil},
+		{"5\n", nil},
+	}
+	for _, tt := range tests {
+		s := NewScanner("", true, strings.NewReader(tt.input), ioutil.Discard, nil)
+		got, err := s.askForEntry(entries)
+		if got != tt.want || (err == nil) != (tt.want != nil) {
+			t.Errorf("askForEntry() with input %q = %v, %v, want %v", tt.input, got, err, tt.want)
+		}
+	}
+}
+
+// stubMDNS makes the mDNS queries return the given entries, or fail
+// with err if it's not nil. Calling the returned function restores
+// the real queries.
+func stubMDNS(entries []*mdns.ServiceEntry, err error) func() {
+	prev := mdnsQuery
+	mdnsQuery = func(params *mdns.QueryParam) error {
+		if err != nil {
+			return err
+		}
+		for _, v := range entries {
+			params.Entries <- v
+		}
+		return nil
+	}
+	return func() {
+		mdnsQuery = prev
+	}
+}
+
+func TestParseAddressPolicy(t *testing.T) {
+	for _, v := range []string{"ipv4", "V4", "4"} {
+		if p, err := ParseAddressPolicy(v); err != nil || p != PreferIPv4 {
+			t.Errorf("ParseAddressPolicy(%q) = %v, %v, want PreferIPv4", v, p, err)
+		}
+	}
+	for _, v := range []string{"IPv6", "v6", "6"} {
+		if p, err := ParseAddressPolicy(v); err != nil || p != PreferIPv6 {
+			t.Errorf("ParseAddressPolicy(%q) = %v, %v, want PreferIPv6", v, p, err)
+		}
+	}
+	if _, err := ParseAddressPolicy("ipv5"); err == nil {
+		t.Error("ParseAddressPolicy(\"ipv5\") = nil, want an error")
+	}
+}
+
+func TestNewHostInfo(t *testing.T) {
+	en0 := &net.Interface{Name: "en0"}
+	tests := []struct {
+		name  string
+		entry *mdns.ServiceEntry
+		iface *net.Interface
+		want  *HostInfo
+	}{
+		{
+			name:  "IPv4",
+			entry: &mdns.ServiceEntry{Host: "a.local.", Port: 8888, AddrV4: net.ParseIP("192.168.1.10"), InfoFields: []string{"version=v1=2", "debug", ""}},
+			iface: en0,
+			want:  &HostInfo{Host: "a.local.", IPv4: "192.168.1.10", Port: 8888, TXT: map[string]string{"version": "v1=2", "debug": ""}},
+		},
+		{
+			name:  "global IPv6",
+			entry: &mdns.ServiceEntry{Host: "a.local.", Port: 8888, AddrV6: net.ParseIP("2001:db8::1")},
+			iface: en0,
+			want:  &HostInfo{Host: "a.local.", IPv6: "2001:db8::1", Port: 8888},
+		},
+		{
+			name:  "link-local IPv6",
+			entry: &mdns.ServiceEntry{Host: "a.local.", Port: 8888, AddrV6: net.ParseIP("fe80::1")},
+			iface: en0,
+			want:  &HostInfo{Host: "a.local.", IPv6: "fe80::1%en0", Port: 8888},
+		},
+		{
+			name:  "link-local IPv6 on unknown interface",
+			entry: &mdns.ServiceEntry{Host: "a.local.", Port: 8888, AddrV6: net.ParseIP("fe80::1")},
+			want:  &HostInfo{Host: "a.local.", IPv6: "fe80::1", Port: 8888},
+		},
+	}
+	for _, tt := range tests {
+		if got := newHostInfo(tt.entry, tt.iface); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: newHostInfo() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHostInfoAddrs(t *testing.T) {
+	tests := []struct {
+		info   *HostInfo
+		policy AddressPolicy
+		want   []string
+	}{
+		{&HostInfo{IPv4: "192.168.1.10", IPv6: "fe80::1%en0", Port: 8888}, PreferIPv4, []string{"192.168.1.10:8888", "[fe80::1%en0]:8888"}},
+		{&HostInfo{IPv4: "192.168.1.10", IPv6: "fe80::1%en0", Port: 8888}, PreferIPv6, []string{"[fe80::1%en0]:8888", "192.168.1.10:8888"}},
+		{&HostInfo{IPv4: "192.168.1.10", Port: 8888}, PreferIPv6, []string{"192.168.1.10:8888"}},
+		{&HostInfo{IPv6: "2001:db8::1", Port: 8888}, PreferIPv4, []string{"[2001:db8::1]:8888"}},
+		{&HostInfo{Port: 8888}, PreferIPv4, nil},
+	}
+	for _, tt := range tests {
+		if got := tt.info.Addrs(tt.policy); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Addrs(%v) for %+v = %v, want %v", tt.policy, tt.info, got, tt.want)
+		}
+	}
+}
+
+func TestHostInfoMerge(t *testing.T) {
+	// The same host seen on two interfaces, with a different
+	// address family on each one
+	h := &HostInfo{Host: "a.local.", IPv4: "192.168.1.10", Port: 8888}
+	h.merge(&HostInfo{Host: "a.local.", IPv4: "10.0.0.10", IPv6: "fe80::1%en1", Port: 8888, TXT: map[string]string{"chip": "esp32"}})
+	want := &HostInfo{Host: "a.local.", IPv4: "192.168.1.10", IPv6: "fe80::1%en1", Port: 8888, TXT: map[string]string{"chip": "esp32"}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("merge() = %+v, want %+v", h, want)
+	}
+}
+
+func TestScannerLookup(t *testing.T) {
+	defer stubMDNS([]*mdns.ServiceEntry{
+		{Host: "lab-2.local.", Port: 8888, AddrV4: net.ParseIP("192.168.1.11")},
+		{Host: "lab-1.local.", Port: 8888, AddrV4: net.ParseIP("192.168.1.10")},
+		{Host: "lab-1.local.", Port: 8888, AddrV6: net.ParseIP("2001:db8::1")},
+		{Host: "office.local.", Port: 8888, AddrV4: net.ParseIP("10.0.2.20")},
+	}, nil)()
+	s := NewScanner("LAB", false, nil, ioutil.Discard, nil)
+	s.Policy = PreferIPv6
+	hosts, err := s.Lookup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*HostInfo{
+		{Host: "lab-1.local.", IPv4: "192.168.1.10", IPv6: "2001:db8::1", Port: 8888},
+		{Host: "lab-2.local.", IPv4: "192.168.1.11", Port: 8888},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("Lookup() = %+v, want %+v", hosts, want)
+	}
+	if got, want := hosts[0].Addrs(s.Policy), []string{"[2001:db8::1]:8888", "192.168.1.10:8888"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Addrs() = %v, want %v", got, want)
+	}
+}
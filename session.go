@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// sessionEnd is sent by the connection goroutine when the
+// connection attempt fails or the established connection ends
+type sessionEnd struct {
+	// host is nil if the scan for the host failed
+	host *Host
+	err  error
+}
+
+// session monitors a single host. It owns the connection lifecycle,
+// reconnecting according to the reconnect policy, and runs the commands
+// from the keyboard and the flash jobs. Its state is only accessed by
+// the goroutine calling run(), the connection and flash goroutines
+// report back through channels.
+type session struct {
+	c    *Client
+	km   *keyboardMonitor
+	info *ProjectInfo
+	// host is the host given with -addr, nil to scan for
+	// a host matching filter
+	host        *Host
+	filter      string
+	policy      AddressPolicy
+	inv         *Inventory
+	interactive bool
+	reconnect   *ReconnectPolicy
+	stdout      io.Writer
+
+	// flashRequests receives the flash requests from the watcher.
+	// It's buffered, so requests made while flashing are coalesced
+	// into a single one.
+	flashRequests chan struct{}
+
+	connected chan *Host
+	ended     chan sessionEnd
+	flashDone chan error
+	flashing  bool
+	// pendingFlash is true when a flash was requested
+	// by the watcher while flashing
+	pendingFlash bool
+}
+
+func newSession(c *Client, km *keyboardMonitor, host *Host, filter string, policy AddressPolicy, inv *Inventory, interactive bool, reconnect *ReconnectPolicy) *session {
+	return &session{
+		c:             c,
+		km:            km,
+		info:          c.ProjectInfo(),
+		host:          host,
+		filter:        filter,
+		policy:        policy,
+		inv:           inv,
+		interactive:   interactive,
+		reconnect:     reconnect,
+		stdout:        c.Stdout(),
+		flashRequests: make(chan struct{}, 1),
+		connected:     make(chan *Host, 1),
+		ended:         make(chan sessionEnd, 1),
+		flashDone:     make(chan error, 1),
+	}
+}
+
+// requestFlash asks the session to rebuild and flash the app once
+// the current flash, if any, finishes. It never blocks.
+func (s *session) requestFlash() {
+	select {
+	case s.flashRequests <- struct{}{}:
+	default:
+	}
+}
+
+// connect finds the host, connects to it and runs the client until the
+// connection ends. It must be called in its own goroutine, only one
+// can run at a time.
+func (s *session) connect(ctx context.Context, filter string) {
+	host := s.host
+	if host == nil {
+		hostCh := make(chan *Host, 1)
+		errCh := make(chan error, 1)
+		sc := NewScanner(filter, s.interactive, s.c.Stdin(), s.stdout, hostCh)
+		sc.Policy = s.policy
+		sc.Inventory = s.inv
+		sc.Errors = errCh
+		sc.Scan(ctx)
+		select {
+		case host = <-hostCh:
+		case err := <-errCh:
+			s.ended <- sessionEnd{err: err}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+	s.c.Host = host
+	if err := s.c.Connect(ctx); err != nil {
+		s.ended <- sessionEnd{host: host, err: &connectError{err}}
+		return
+	}
+	s.connected <- host
+	err := s.c.Run(ctx)
+	s.c.Close()
+	s.ended <- sessionEnd{host: host, err: err}
+}
+
+// flash starts a flash job, unless one is already running. The
+// job is canceled when ctx is done.
+func (s *session) flash(ctx context.Context) bool {
+	if s.flashing {
+		return false
+	}
+	s.flashing = true
+	fmt.Fprintf(s.stdout, "flashing %s to host...\n", filepath.Base(s.info.AppBin))
+	go func() {
+		// Flashing blocks until the host reports the result, so
+		// the session keeps handling events in the meantime
+		s.flashDone <- flash(ctx, s.km, s.c)
+	}()
+	return true
+}
+
+// handleKey runs the command for the given key, returning
+// true when the user wants to quit
+func (s *session) handleKey(ctx context.Context, key byte) bool {
+	switch key {
+	case kmSigInt:
+		s.km.Close()
+		syscall.Kill(syscall.Getpid(), syscall.SIGINT)
+	case 'c':
+		// Waiting for the configuration and the user input
+		// blocks, so handle it in its own goroutine
+		go func() {
+			if err := promptConfig(ctx, s.km, s.c); err != nil {
+				fmt.Fprintf(s.stdout, "%v\n", err)
+			}
+		}()
+	case 'f':
+		if !s.flash(ctx) {
+			fmt.Fprintf(s.stdout, "already flashing, please wait\n")
+		}
+	case 'r':
+		// Reboot the board
+		if err := s.c.Reboot(ctx); err != nil {
+			fmt.Fprintf(s.stdout, "error rebooting host: %v\n", err)
+		}
+	case 'q':
+		return true
+	}
+	return false
+}
+
+// run runs the session until the user quits, the connection ends
+// without an error, the reconnect policy gives up or ctx is done.
+// Quitting cancels any flash job in progress.
+func (s *session) run(ctx context.Context, input <-chan byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer s.c.Close()
+
+	r := newReconnector(s.reconnect)
+	filter := s.filter
+	// retryCh fires when it's time to reconnect, giveUpCh when
+	// the reconnection timeout expires while scanning
+	var retryCh, giveUpCh <-chan time.Time
+	go s.connect(ctx, filter)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case key := <-input:
+			if s.handleKey(ctx, key) {
+				return nil
+			}
+		case host := <-s.connected:
+			giveUpCh = nil
+			if attempts, downtime, ok := r.connected(); ok {
+				fmt.Fprintf(s.stdout, "reconnected to %s after %d attempts, down for %v\n", host.Host, attempts, roundDuration(downtime))
+			} else {
+				fmt.Fprintf(s.stdout, "connected to %s\n", host.Host)
+			}
+		case end := <-s.ended:
+			giveUpCh = nil
+			if end.err == nil {
+				// nil err, requested exit
+				return nil
+			}
+			if end.host == nil {
+				// Scanning failed, there's no host to reconnect to
+				return end.err
+			}
+			// Reconnect to the same host. Hosts given with -addr
+			// are reused as is, without resolving them again.
+			filter = end.host.Host
+			if _, ok := end.err.(*connectError); ok {
+				fmt.Fprintf(s.stdout, "%v\n", end.err)
+			} else {
+				fmt.Fprintf(s.stdout, "disconnected from %s: %v\n", filter, end.err)
+			}
+			delay, err := r.next(filter)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(s.stdout, "reconnecting to %s in %v (attempt %d)...\n", filter, roundDuration(delay), r.attempt())
+			retryCh = time.After(delay)
+		case <-retryCh:
+			retryCh = nil
+			if left := r.remaining(); left > 0 {
+				giveUpCh = time.After(left)
+			}
+			go s.connect(ctx, filter)
+		case <-giveUpCh:
+			// Still scanning for the host
+			_, err := r.next(filter)
+			return err
+		case <-s.flashRequests:
+			if !s.flash(ctx) {
+				s.pendingFlash = true
+			}
+		case err := <-s.flashDone:
+			s.flashing = false
+			if err != nil {
+				fmt.Fprintf(s.stdout, "error flashing: %v\n", err)
+			}
+			if s.pendingFlash {
+				s.pendingFlash = false
+				s.flash(ctx)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+	"github.com/micro/mdns"
+)
+
+// testSession is a session monitoring a fake device, with
+// run running in its own goroutine
+type testSession struct {
+	*session
+	stdout lockedBuffer
+	input  chan byte
+	done   chan error
+}
+
+// testReconnectPolicy reconnects quickly, without giving up
+var testReconnectPolicy = ReconnectPolicy{Delay: 50 * time.Millisecond, MaxDelay: 200 * time.Millisecond}
+
+func startSession(t *testing.T, d *fakedevice.Device, info *ProjectInfo, policy ReconnectPolicy) *testSession {
+	t.Helper()
+	ts := &testSession{input: make(chan byte), done: make(chan error, 1)}
+	c := NewClient(info, strings.NewReader(""), &ts.stdout, &ts.stdout)
+	host := &Host{Host: d.Name, Addrs: []string{d.Addr()}}
+	ts.session = newSession(c, &keyboardMonitor{}, host, "", PreferIPv4, nil, false, &policy)
+	go func() {
+		ts.done <- ts.run(context.Background(), ts.input)
+	}()
+	return ts
+}
+
+// waitOutput waits until the session prints s
+func (ts *testSession) waitOutput(t *testing.T, s string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(ts.stdout.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, output:\n%s", s, ts.stdout.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// quit quits the session and waits for run to return
+func (ts *testSession) quit(t *testing.T) {
+	t.Helper()
+	ts.input <- 'q'
+	select {
+	case err := <-ts.done:
+		if err != nil {
+			t.Errorf("run() = %v after quitting, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the session to quit")
+	}
+}
+
+func (ts *testSession) waitHandshake(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.c.WaitHandshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionConcurrentRequests(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	ts := startSession(t, d, &ProjectInfo{}, testReconnectPolicy)
+	ts.waitHandshake(t)
+
+	image := testImage(200000)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := ts.c.Flash(ctx, bytes.NewReader(image)); err != nil {
+			t.Errorf("Flash() = %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for ii := 0; ii < 20; ii++ {
+			if _, err := ts.c.GetConfig(ctx); err != nil {
+				t.Errorf("GetConfig() = %v", err)
+				return
+			}
+			d.Printf("line %d\n", ii)
+		}
+	}()
+	wg.Wait()
+	if !bytes.Equal(d.Image(), image) {
+		t.Error("image was not flashed")
+	}
+
+	// Rebooting drops the connection, the session should reconnect
+	ts.input <- 'r'
+	ts.waitOutput(t, "reconnected to dev")
+	ts.waitHandshake(t)
+	if _, err := ts.c.GetConfig(ctx); err != nil {
+		t.Errorf("GetConfig() after reconnecting = %v", err)
+	}
+	if n := d.Reboots(); n != 1 {
+		t.Errorf("device rebooted %d times, want 1", n)
+	}
+	ts.quit(t)
+}
+
+func TestSessionGivesUp(t *testing.T) {
+	d := startDevice(t, fakedevice.New("dev"))
+	policy := testReconnectPolicy
+	policy.MaxAttempts = 2
+	ts := startSession(t, d, &ProjectInfo{}, policy)
+	ts.waitHandshake(t)
+	d.Close()
+	select {
+	case err := <-ts.done:
+		if err == nil || !strings.Contains(err.Error(), "giving up") {
+			t.Errorf("run() = %v, want giving up error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the session to give up")
+	}
+}
+
+func TestSessionFlashRequests(t *testing.T) {
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make is not available")
+	}
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := testImage(100000)
+	info := &ProjectInfo{Path: dir, BuildSystem: buildSystemMake, AppBin: filepath.Join(dir, "app.bin")}
+	if err := ioutil.WriteFile(info.AppBin, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The image is already built, so make has nothing to do
+	if err := ioutil.WriteFile(filepath.Join(dir, "Makefile"), []byte(info.AppBin+":\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := startDevice(t, fakedevice.New("dev"))
+	defer d.Close()
+	ts := startSession(t, d, info, testReconnectPolicy)
+	ts.waitHandshake(t)
+	// Requests made while flashing are coalesced
+	ts.requestFlash()
+	ts.requestFlash()
+	ts.requestFlash()
+	ts.waitOutput(t, "flashing app.bin to host")
+	deadline := time.Now().Add(10 * time.Second)
+	for !bytes.Equal(d.Image(), image) {
+		if time.Now().After(deadline) {
+			t.Fatalf("image was not flashed, output:\n%s", ts.stdout.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.quit(t)
+	if strings.Contains(ts.stdout.String(), "error flashing") {
+		t.Errorf("flashing failed, output:\n%s", ts.stdout.String())
+	}
+}
+
+func TestSessionScanWithoutInput(t *testing.T) {
+	defer stubMDNS([]*mdns.ServiceEntry{
+		{Host: "a.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 10}},
+		{Host: "b.local.", Port: 8888, AddrV4: []byte{192, 168, 1, 11}},
+	}, nil)()
+	var stdout lockedBuffer
+	c := NewClient(&ProjectInfo{}, strings.NewReader(""), &stdout, &stdout)
+	policy := testReconnectPolicy
+	s := newSession(c, &keyboardMonitor{}, nil, "", PreferIPv4, nil, true, &policy)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(context.Background(), make(chan byte))
+	}()
+	// Two hosts are found, but there's no input to select one
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "no input") {
+			t.Errorf("run() = %v, want an error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("session kept waiting for a host, output:\n%s", stdout.String())
+	}
+}
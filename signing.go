@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	pemPrivateKeyType = "PRIVATE KEY"
+	pemPublicKeyType  = "PUBLIC KEY"
+)
+
+// LoadSigningKey reads an Ed25519 private key in PKCS #8 PEM format
+// from path. A missing file is not an error, a nil key is returned.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemPrivateKeyType {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an Ed25519 key", path)
+	}
+	return priv, nil
+}
+
+func generateSigningKey(path string) (ed25519.PrivateKey, error) {
+	if fileExists(path) {
+		return nil, fmt.Errorf("%s already exists, remove it first to generate a new key", path)
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: pemPrivateKeyType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// printPublicKey prints the public key for priv, both in PEM format and
+// as a raw hex string which can be embedded in the firmware.
+func printPublicKey(w io.Writer, priv ed25519.PrivateKey) error {
+	pub := priv.Public().(ed25519.PublicKey)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	w.Write(pem.EncodeToMemory(&pem.Block{Type: pemPublicKeyType, Bytes: der}))
+	fmt.Fprintf(w, "raw: %s\n", hex.EncodeToString(pub))
+	return nil
+}
+
+// runKeyCommand implements the key generate and show subcommands
+func runKeyCommand(path string, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return usageErrorf("usage: key generate|show")
+	}
+	switch args[0] {
+	case "generate":
+		priv, err := generateSigningKey(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "signing key written to %s, configure the device with its public key:\n", path)
+		return printPublicKey(w, priv)
+	case "show":
+		priv, err := LoadSigningKey(path)
+		if err != nil {
+			return err
+		}
+		if priv == nil {
+			return fmt.Errorf("no signing key at %s, create one with key generate", path)
+		}
+		return printPublicKey(w, priv)
+	}
+	return usageErrorf("unknown key command %q", args[0])
+}
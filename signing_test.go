@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fiam/idf_wmonitor/fakedevice"
+)
+
+func TestKeyCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys", "signing.pem")
+
+	var out bytes.Buffer
+	if err := runKeyCommand(path, []string{"show"}, &out); err == nil {
+		t.Error("key show without a key = nil, want an error")
+	}
+	if err := runKeyCommand(path, []string{"generate"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := fakedevice.ParsePublicKey(out.Bytes())
+	if err != nil {
+		t.Fatalf("parsing public key from %q: %v", out.String(), err)
+	}
+	if err := runKeyCommand(path, []string{"generate"}, ioutil.Discard); err == nil {
+		t.Error("key generate with an existing key = nil, want an error")
+	}
+	out.Reset()
+	if err := runKeyCommand(path, []string{"show"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	shown, err := fakedevice.ParsePublicKey(out.Bytes())
+	if err != nil {
+		t.Fatalf("parsing public key from %q: %v", out.String(), err)
+	}
+	if !bytes.Equal(shown, generated) {
+		t.Error("key show printed a different public key than key generate")
+	}
+	priv, err := LoadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub := priv.Public().(ed25519.PublicKey); !bytes.Equal(pub, generated) {
+		t.Error("loaded key doesn't match the generated one")
+	}
+}
+
+func TestLoadSigningKeyInvalid(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDer, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not PEM", []byte("not a key\n")},
+		{"public key", pem.EncodeToMemory(&pem.Block{Type: pemPublicKeyType, Bytes: der})},
+		{"truncated", pem.EncodeToMemory(&pem.Block{Type: pemPrivateKeyType, Bytes: der[:len(der)-4]})},
+		{"not Ed25519", pem.EncodeToMemory(&pem.Block{Type: pemPrivateKeyType, Bytes: ecDer})},
+	}
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(tt.name, " ", "_", -1)+".pem")
+			if err := ioutil.WriteFile(path, tt.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if key, err := LoadSigningKey(path); err == nil {
+				t.Errorf("LoadSigningKey() = %v, nil, want an error", key)
+			}
+		})
+	}
+	t.Run("missing", func(t *testing.T) {
+		key, err := LoadSigningKey(filepath.Join(dir, "missing.pem"))
+		if key != nil || err != nil {
+			t.Errorf("LoadSigningKey() = %v, %v, want nil, nil", key, err)
+		}
+	})
+}
+
+func TestClientFlashSigned(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		key     ed25519.PrivateKey
+		wantErr error
+	}{
+		{"valid", priv, nil},
+		{"missing", nil, ErrOTASignatureRejected},
+		{"wrong", otherPriv, ErrOTASignatureRejected},
+	}
+	image := testImage(50000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := fakedevice.New("dev")
+			d.PublicKey = pub
+			startDevice(t, d)
+			defer d.Close()
+			c := connectClient(t, d, func(c *Client) { c.SigningKey = tt.key })
+			defer c.close(t)
+			if err := c.Flash(context.Background(), bytes.NewReader(image)); err != tt.wantErr {
+				t.Errorf("Flash() = %v, want %v", err, tt.wantErr)
+			}
+			if flashed := bytes.Equal(d.Image(), image); flashed != (tt.wantErr == nil) {
+				t.Errorf("image flashed = %v", flashed)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// symbolizerCheckInterval is the minimum time between checks for
+// changes in the app ELF while decoding the addresses in the output
+const symbolizerCheckInterval = time.Second
+
+// SourceLocation is the result of resolving an address in the app ELF
+type SourceLocation struct {
+	Function string
+	File     string
+	Line     int
+}
+
+func (loc *SourceLocation) String() string {
+	if loc.File == "" {
+		return loc.Function
+	}
+	return fmt.Sprintf("%s at %s:%d", loc.Function, loc.File, loc.Line)
+}
+
+type symbolEntry struct {
+	addr uint64
+	size uint64
+	name string
+}
+
+type lineEntry struct {
+	addr uint64
+	file string
+	line int
+	// end is true for entries marking the end of a sequence
+	end bool
+}
+
+// Symbolizer resolves addresses to functions and source locations
+// using the symbol table and the DWARF line tables from an ELF file
+type Symbolizer struct {
+	path    string
+	modTime time.Time
+	symbols []symbolEntry
+	lines   []lineEntry
+}
+
+// NewSymbolizer loads the symbols from the ELF file at path
+func NewSymbolizer(path string) (*Symbolizer, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &Symbolizer{
+		path:    path,
+		modTime: st.ModTime(),
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range syms {
+		if elf.ST_TYPE(v.Info) != elf.STT_FUNC || v.Value == 0 {
+			continue
+		}
+		s.symbols = append(s.symbols, symbolEntry{addr: v.Value, size: v.Size, name: v.Name})
+	}
+	sort.Slice(s.symbols, func(i, j int) bool {
+		return s.symbols[i].addr < s.symbols[j].addr
+	})
+	// Line information is optional, we can still resolve
+	// function names without it
+	if d, err := f.DWARF(); err == nil {
+		s.loadLines(d)
+	}
+	return s, nil
+}
+
+func (s *Symbolizer) loadLines(d *dwarf.Data) {
+	r := d.Reader()
+	for {
+		cu, err := r.Next()
+		if err != nil || cu == nil {
+			break
+		}
+		if cu.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		lr, err := d.LineReader(cu)
+		if err == nil && lr != nil {
+			var entry dwarf.LineEntry
+			for lr.Next(&entry) == nil {
+				le := lineEntry{addr: entry.Address, line: entry.Line, end: entry.EndSequence}
+				if entry.File != nil {
+					le.file = entry.File.Name
+				}
+				s.lines = append(s.lines, le)
+			}
+		}
+		r.SkipChildren()
+	}
+	sort.SliceStable(s.lines, func(i, j int) bool {
+		return s.lines[i].addr < s.lines[j].addr
+	})
+}
+
+// IsStale returns true if the ELF file has changed since it was loaded
+func (s *Symbolizer) IsStale() bool {
+	st, err := os.Stat(s.path)
+	return err != nil || !st.ModTime().Equal(s.modTime)
+}
+
+// Lookup resolves the given address. It returns nil if the address
+// is not inside any function.
+func (s *Symbolizer) Lookup(addr uint64) *SourceLocation {
+	idx := sort.Search(len(s.symbols), func(i int) bool {
+		return s.symbols[i].addr > addr
+	}) - 1
+	if idx < 0 {
+		return nil
+	}
+	sym := s.symbols[idx]
+	if sym.size > 0 && addr >= sym.addr+sym.size {
+		return nil
+	}
+	loc := &SourceLocation{Function: sym.name}
+	idx = sort.Search(len(s.lines), func(i int) bool {
+		return s.lines[i].addr > addr
+	}) - 1
+	if idx >= 0 && !s.lines[idx].end {
+		loc.File = s.lines[idx].file
+		loc.Line = s.lines[idx].line
+	}
+	return loc
+}
+
+// Describe returns a human readable description of addr, including
+// its function and source location if known.
+func (s *Symbolizer) Describe(addr uint64) string {
+	if s != nil {
+		if loc := s.Lookup(addr); loc != nil {
+			return loc.String()
+		}
+	}
+	return "??"
+}
+
+// symbolizer returns a Symbolizer for the app ELF, reloading it
+// if the app has been rebuilt since it was loaded.
+func (c *Client) symbolizer() (*Symbolizer, error) {
+	c.symMu.Lock()
+	defer c.symMu.Unlock()
+	if c.sym == nil || c.sym.IsStale() {
+		sym, err := NewSymbolizer(c.info.AppElf)
+		if err != nil {
+			return nil, err
+		}
+		c.sym = sym
+	}
+	return c.sym, nil
+}
+
+// addressSymbolizer returns the Symbolizer used to decode addresses
+// in the output, or nil if the app ELF can't be loaded. Since it's
+// called for every line with addresses, the ELF is checked at most
+// once every symbolizerCheckInterval.
+func (c *Client) addressSymbolizer() *Symbolizer {
+	c.symMu.Lock()
+	if time.Since(c.symChecked) < symbolizerCheckInterval {
+		defer c.symMu.Unlock()
+		if c.symWarned {
+			// Loading failed in the last check
+			return nil
+		}
+		return c.sym
+	}
+	c.symMu.Unlock()
+	sym, err := c.symbolizer()
+	c.symMu.Lock()
+	defer c.symMu.Unlock()
+	c.symChecked = time.Now()
+	if err != nil {
+		if !c.symWarned {
+			fmt.Fprintf(c.stderr, "can't decode addresses, error loading %s: %v\n", c.info.AppElf, err)
+			c.symWarned = true
+		}
+		return nil
+	}
+	c.symWarned = false
+	return sym
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewSymbolizerInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "app.*.elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not an ELF file")
+	f.Close()
+	if _, err := NewSymbolizer(f.Name()); err == nil {
+		t.Error("NewSymbolizer() with an invalid file = nil, want an error")
+	}
+	if _, err := NewSymbolizer(f.Name() + ".missing"); err == nil {
+		t.Error("NewSymbolizer() with a missing file = nil, want an error")
+	}
+}
+
+func TestSymbolizerIsStale(t *testing.T) {
+	f, err := ioutil.TempFile("", "app.*.elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+	st, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Symbolizer{path: f.Name(), modTime: st.ModTime()}
+	if s.IsStale() {
+		t.Error("IsStale() = true for an unchanged file")
+	}
+	os.Chtimes(f.Name(), time.Now(), st.ModTime().Add(time.Second))
+	if !s.IsStale() {
+		t.Error("IsStale() = false for a modified file")
+	}
+	os.Remove(f.Name())
+	if !s.IsStale() {
+		t.Error("IsStale() = false for a removed file")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// watchPollInterval is the time between scans of the project tree
+	watchPollInterval = 500 * time.Millisecond
+)
+
+// defaultWatchIgnore contains the patterns always ignored by the
+// watcher, in addition to the build directory
+var defaultWatchIgnore = []string{".*", "*~", "*.swp", "*.tmp", "sdkconfig.old"}
+
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// projectWatcher detects changes in the project tree by polling it
+type projectWatcher struct {
+	root string
+	// ignore contains glob patterns, matched against both the base
+	// name and the slash separated path relative to root
+	ignore []string
+	// ignoreDirs contains absolute paths to ignored directories
+	ignoreDirs []string
+	// debounce is the time without changes to wait for before
+	// reporting them
+	debounce time.Duration
+	files    map[string]watchedFile
+}
+
+// newProjectWatcher returns a projectWatcher for the given project,
+// ignoring its build directory and the files matching the given
+// patterns
+func newProjectWatcher(info *ProjectInfo, ignore []string, debounce time.Duration) *projectWatcher {
+	w := &projectWatcher{
+		root:     info.Path,
+		ignore:   append(append([]string(nil), defaultWatchIgnore...), ignore...),
+		debounce: debounce,
+	}
+	for _, v := range []string{info.BuildDir, filepath.Dir(info.AppBin)} {
+		if v != "" && v != "." {
+			if abs, err := filepath.Abs(v); err == nil {
+				w.ignoreDirs = append(w.ignoreDirs, abs)
+			}
+		}
+	}
+	return w
+}
+
+// parseWatchIgnore splits a comma separated list of patterns
+func parseWatchIgnore(s string) ([]string, error) {
+	var patterns []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if _, err := filepath.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %v", v, err)
+		}
+		patterns = append(patterns, v)
+	}
+	return patterns, nil
+}
+
+func (w *projectWatcher) ignored(path string, rel string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		for _, v := range w.ignoreDirs {
+			if abs == v {
+				return true
+			}
+		}
+	}
+	base := filepath.Base(rel)
+	rel = filepath.ToSlash(rel)
+	for _, v := range w.ignore {
+		if ok, _ := filepath.Match(v, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(v, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scan walks the project tree, returning the files in it
+func (w *projectWatcher) scan() (map[string]watchedFile, error) {
+	files := make(map[string]watchedFile)
+	err := filepath.Walk(w.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while walking
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && w.ignored(path, rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			files[rel] = watchedFile{modTime: fi.ModTime(), size: fi.Size()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// changes returns the files which were added, removed or
+// modified in files with respect to the previous scan
+func (w *projectWatcher) changes(files map[string]watchedFile) []string {
+	var changed []string
+	for k, v := range files {
+		if prev, ok := w.files[k]; !ok || prev != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range w.files {
+		if _, ok := files[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	return changed
+}
+
+// Start performs the initial scan of the project, so
+// Watch only reports changes made afterwards
+func (w *projectWatcher) Start() error {
+	files, err := w.scan()
+	if err != nil {
+		return err
+	}
+	w.files = files
+	return nil
+}
+
+// Watch scans the project periodically, sending the changed files to
+// ch once no more changes happen for the debounce time. Start must be
+// called first. It returns when ctx is done, closing ch.
+func (w *projectWatcher) Watch(ctx context.Context, ch chan<- []string) {
+	defer close(ch)
+	pending := make(map[string]bool)
+	var lastChange time.Time
+	for {
+		select {
+		case <-time.After(watchPollInterval):
+		case <-ctx.Done():
+			return
+		}
+		files, err := w.scan()
+		if err != nil {
+			// Try again in the next scan
+			continue
+		}
+		if changed := w.changes(files); len(changed) > 0 {
+			for _, v := range changed {
+				pending[v] = true
+			}
+			lastChange = time.Now()
+		}
+		w.files = files
+		if len(pending) > 0 && time.Since(lastChange) >= w.debounce {
+			changed := make([]string, 0, len(pending))
+			for k := range pending {
+				changed = append(changed, k)
+			}
+			sort.Strings(changed)
+			select {
+			case ch <- changed:
+			case <-ctx.Done():
+				return
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// describeChanges returns a short description of the changed files
+func describeChanges(changed []string) string {
+	switch len(changed) {
+	case 1:
+		return changed[0] + " changed"
+	case 2:
+		return changed[0] + " and " + changed[1] + " changed"
+	}
+	return fmt.Sprintf("%s and %d more files changed", changed[0], len(changed)-1)
+}
+
+// startWatching starts watching the project, calling trigger when it
+// changes, until ctx is done. ignore is a comma separated list of
+// patterns to ignore.
+func startWatching(ctx context.Context, info *ProjectInfo, ignore string, debounce time.Duration, stdout io.Writer, trigger func()) error {
+	patterns, err := parseWatchIgnore(ignore)
+	if err != nil {
+		return usageError(err.Error())
+	}
+	w := newProjectWatcher(info, patterns, debounce)
+	if err := w.Start(); err != nil {
+		return fmt.Errorf("can't watch %s: %v", info.Path, err)
+	}
+	ch := make(chan []string)
+	go w.Watch(ctx, ch)
+	go func() {
+		for changed := range ch {
+			fmt.Fprintf(stdout, "%s, rebuilding...\n", describeChanges(changed))
+			trigger()
+		}
+	}()
+	fmt.Fprintf(stdout, "watching %s for changes\n", info.Path)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testProject creates a project tree in a temporary directory,
+// returning its ProjectInfo
+func testProject(t *testing.T) *ProjectInfo {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"main/main.c", "main/component.mk", "build/app.bin", "build/main/main.o",
+		".git/HEAD", "main/main.c~", "sdkconfig.old", "docs/notes.log", "sdkconfig"} {
+		writeProjectFile(t, filepath.Join(dir, v), "x")
+	}
+	return &ProjectInfo{
+		Path:     dir,
+		BuildDir: filepath.Join(dir, "build"),
+		AppBin:   filepath.Join(dir, "build", "app.bin"),
+	}
+}
+
+func writeProjectFile(t *testing.T, path string, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProjectWatcherIgnore(t *testing.T) {
+	info := testProject(t)
+	defer os.RemoveAll(info.Path)
+	ignore, err := parseWatchIgnore(" docs/*.log ,, sdkconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := newProjectWatcher(info, ignore, 0).scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for k := range files {
+		names = append(names, filepath.ToSlash(k))
+	}
+	sort.Strings(names)
+	if want := []string{"main/component.mk", "main/main.c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("scanned files = %v, want %v", names, want)
+	}
+	if _, err := parseWatchIgnore("a,[b"); err == nil {
+		t.Error("parseWatchIgnore() with an invalid pattern = nil, want an error")
+	}
+}
+
+func TestProjectWatcherWatch(t *testing.T) {
+	info := testProject(t)
+	defer os.RemoveAll(info.Path)
+	w := newProjectWatcher(info, nil, 100*time.Millisecond)
+	if err := w.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []string)
+	go w.Watch(ctx, ch)
+
+	// Changes to ignored files are not reported
+	writeProjectFile(t, filepath.Join(info.Path, "build", "app.bin"), "changed")
+	writeProjectFile(t, filepath.Join(info.Path, "main", ".main.c.swp"), "changed")
+	writeProjectFile(t, filepath.Join(info.Path, "main", "main.c"), "changed")
+	writeProjectFile(t, filepath.Join(info.Path, "main", "new.c"), "new")
+	if err := os.Remove(filepath.Join(info.Path, "main", "component.mk")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case changed := <-ch:
+		want := []string{filepath.Join("main", "component.mk"), filepath.Join("main", "main.c"), filepath.Join("main", "new.c")}
+		if !reflect.DeepEqual(changed, want) {
+			t.Errorf("changed = %v, want %v", changed, want)
+		}
+		if got, want := describeChanges(changed), want[0]+" and 2 more files changed"; got != want {
+			t.Errorf("describeChanges() = %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for changes")
+	}
+
+	// Watch returns when ctx is done, closing the channel
+	cancel()
+	select {
+	case changed, ok := <-ch:
+		if ok {
+			t.Errorf("received %v after canceling", changed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch() didn't return after canceling")
+	}
+}